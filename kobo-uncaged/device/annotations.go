@@ -0,0 +1,270 @@
+package device
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// kuAnnotationsDir is where annotation backups are written, relative to
+// the root of the internal storage
+const kuAnnotationsDir = ".adds/kobo-uncaged/annotations"
+
+// annotationsDateFormat is used when displaying annotation dates
+const annotationsDateFormat = "2 Jan 2006 15:04"
+
+// annotation is a highlight or note made in Nickel
+type annotation struct {
+	BookmarkID  string     `json:"bookmarkId"`
+	Type        string     `json:"type,omitempty"`
+	Chapter     string     `json:"chapter,omitempty"`
+	Text        string     `json:"text,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Progress    float64    `json:"chapterProgress"`
+	DateCreated *time.Time `json:"dateCreated,omitempty"`
+}
+
+// readAnnotations gets the highlights and notes of all books whose ContentID
+// matches cidLike, keyed by ContentID. Bookmarks without text or a note
+// (such as dogears) are skipped.
+func readAnnotations(db *sql.DB, caps *nickelCaps, cidLike string) (map[string][]annotation, error) {
+	// The Type column is not present in older firmware
+	typeCol := "''"
+	if caps.bookmarkType() {
+		typeCol = "bm.Type"
+	}
+	rows, err := db.Query(`SELECT bm.VolumeID, bm.BookmarkID, `+typeCol+`, c.Title, bm.Text, bm.Annotation, bm.ChapterProgress, bm.DateCreated
+		FROM Bookmark bm LEFT OUTER JOIN content c ON c.ContentID = bm.ContentID
+		WHERE bm.VolumeID LIKE ?
+		AND (bm.Hidden IS NULL OR bm.Hidden <> 'true')
+		AND ((bm.Text IS NOT NULL AND bm.Text <> '') OR (bm.Annotation IS NOT NULL AND bm.Annotation <> ''))
+		ORDER BY bm.VolumeID, c.VolumeIndex, bm.ChapterProgress;`, cidLike)
+	if err != nil {
+		return nil, fmt.Errorf("readAnnotations: error getting bookmark rows: %w", err)
+	}
+	defer rows.Close()
+	annotations := make(map[string][]annotation)
+	for rows.Next() {
+		var volumeID, bookmarkID string
+		var bmType, chapter, text, note, created *string
+		var progress *float64
+		if err = rows.Scan(&volumeID, &bookmarkID, &bmType, &chapter, &text, &note, &progress, &created); err != nil {
+			return nil, fmt.Errorf("readAnnotations: bookmark row decoding error: %w", err)
+		}
+		a := annotation{
+			BookmarkID:  bookmarkID,
+			Type:        nullString(bmType),
+			Chapter:     nullString(chapter),
+			Text:        nullString(text),
+			Note:        nullString(note),
+			DateCreated: parseNickelTime(created),
+		}
+		if progress != nil {
+			a.Progress = *progress
+		}
+		annotations[volumeID] = append(annotations[volumeID], a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("readAnnotations: bookmark rows error: %w", err)
+	}
+	return annotations, nil
+}
+
+// nullString returns the trimmed value of a nullable DB string
+func nullString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s)
+}
+
+// annotationsHTML renders annotations in a form suitable for a Calibre
+// comments column.
+func annotationsHTML(annotations []annotation) string {
+	var sb strings.Builder
+	for i, a := range annotations {
+		if i > 0 {
+			sb.WriteString("<hr/>")
+		}
+		sb.WriteString("<div>")
+		var heading []string
+		if a.Chapter != "" {
+			heading = append(heading, "<strong>"+html.EscapeString(a.Chapter)+"</strong>")
+		}
+		if a.DateCreated != nil {
+			heading = append(heading, "<em>"+a.DateCreated.Local().Format(annotationsDateFormat)+"</em>")
+		}
+		if len(heading) > 0 {
+			sb.WriteString("<p>" + strings.Join(heading, " &mdash; ") + "</p>")
+		}
+		if a.Text != "" {
+			sb.WriteString("<blockquote>" + html.EscapeString(a.Text) + "</blockquote>")
+		}
+		if a.Note != "" {
+			sb.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(a.Note), "\n", "<br/>") + "</p>")
+		}
+		sb.WriteString("</div>")
+	}
+	return sb.String()
+}
+
+// setAnnotationsColumn adds the Nickel highlights and notes of a book to the
+// custom column the user has selected.
+func (k *Kobo) setAnnotationsColumn(md *uc.CalibreBookMeta, annotations []annotation) {
+	libOpts, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]
+	if !exists || libOpts.AnnotationsColumn == "" || len(annotations) == 0 {
+		return
+	}
+	cc, ok := k.customColumn(md, libOpts.AnnotationsColumn)
+	if !ok || cc.Datatype != "comments" {
+		return
+	}
+	copyUserMetadata(md)
+	cc.Value = annotationsHTML(annotations)
+	md.UserMetadata[libOpts.AnnotationsColumn] = cc
+}
+
+// annotationBackup is the JSON form of a book's annotation backup
+type annotationBackup struct {
+	Title       string       `json:"title"`
+	Authors     []string     `json:"authors"`
+	Lpath       string       `json:"lpath"`
+	Annotations []annotation `json:"annotations"`
+}
+
+// annotationsMarkdown renders the annotations of a book as markdown
+func annotationsMarkdown(b *annotationBackup) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n\n", b.Title)
+	if len(b.Authors) > 0 {
+		fmt.Fprintf(&buf, "%s\n\n", strings.Join(b.Authors, ", "))
+	}
+	chapter := ""
+	for _, a := range b.Annotations {
+		if a.Chapter != "" && a.Chapter != chapter {
+			chapter = a.Chapter
+			fmt.Fprintf(&buf, "## %s\n\n", chapter)
+		}
+		if a.Text != "" {
+			fmt.Fprintf(&buf, "> %s\n\n", strings.ReplaceAll(a.Text, "\n", "\n> "))
+		}
+		if a.Note != "" {
+			fmt.Fprintf(&buf, "%s\n\n", a.Note)
+		}
+		if a.DateCreated != nil {
+			fmt.Fprintf(&buf, "*%s*\n\n", a.DateCreated.Local().Format(annotationsDateFormat))
+		}
+		buf.WriteString("---\n\n")
+	}
+	return buf.Bytes()
+}
+
+// writeIfChanged writes data to fn, unless fn already has the same content.
+// Whether the file was written is returned.
+func writeIfChanged(fn string, data []byte) (bool, error) {
+	if existing, err := os.ReadFile(fn); err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return false, err
+	}
+	return true, util.WriteFileAtomic(fn, false, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// BackupAnnotations writes the highlights and notes of every sideloaded book
+// to markdown and JSON files on the device. Only files whose content has
+// changed are rewritten. Backups of books no longer on the device are kept.
+func (k *Kobo) BackupAnnotations() (written int, err error) {
+	if k.DryRun() {
+		k.DryRunf("would back up annotations")
+		return 0, nil
+	}
+	nickelDB, err := k.openNickelDB(true)
+	if err != nil {
+		return 0, fmt.Errorf("BackupAnnotations: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return 0, fmt.Errorf("BackupAnnotations: %w", err)
+	}
+	annotations, err := readAnnotations(nickelDB, caps, string(k.ContentIDprefix)+"%")
+	if err != nil {
+		return 0, fmt.Errorf("BackupAnnotations: %w", err)
+	}
+	backupDir := filepath.Join(k.DBRootDir, kuAnnotationsDir)
+	for cid, a := range annotations {
+		b := annotationBackup{Lpath: util.ContentIDtoLpath(cid, string(k.ContentIDprefix)), Annotations: a}
+		b.Title = b.Lpath
+		if m, exists := k.Metadata.Get(cid); exists && m.Meta != nil {
+			b.Title, b.Authors = m.Meta.Title, m.Meta.Authors
+		}
+		jsonData, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return written, fmt.Errorf("BackupAnnotations: error encoding annotations for %s: %w", b.Lpath, err)
+		}
+		fn := filepath.Join(backupDir, b.Lpath)
+		for ext, data := range map[string][]byte{".json": jsonData, ".md": annotationsMarkdown(&b)} {
+			changed, err := writeIfChanged(fn+ext, data)
+			if err != nil {
+				return written, fmt.Errorf("BackupAnnotations: error writing %s: %w", fn+ext, err)
+			}
+			if changed {
+				written++
+			}
+		}
+	}
+	log.Printf("BackupAnnotations: %d annotation file(s) written", written)
+	return written, nil
+}
+
+// annotationFile is an annotation backup listed in the web UI
+type annotationFile struct {
+	Lpath string `json:"lpath"`
+	Path  string `json:"path"`
+}
+
+// listAnnotationBackups gets the markdown and JSON backup files, sorted by lpath
+func (k *Kobo) listAnnotationBackups() ([]annotationFile, error) {
+	backupDir := filepath.Join(k.DBRootDir, kuAnnotationsDir)
+	files := make([]annotationFile, 0)
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || (filepath.Ext(path) != ".md" && filepath.Ext(path) != ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		files = append(files, annotationFile{Lpath: rel, Path: k.webInfo.AnnotationsPath + "/files/" + rel})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listAnnotationBackups: %w", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Lpath < files[j].Lpath })
+	return files, nil
+}
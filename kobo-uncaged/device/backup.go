@@ -0,0 +1,287 @@
+package device
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+)
+
+const kuBackupDir = ".adds/kobo-uncaged/backups"
+const snapshotInfoFile = "snapshot.json"
+const snapshotNameFormat = "20060102-150405"
+
+// The Nickel DB can be large, so only the most recent snapshots are kept
+const maxSnapshots = 3
+
+// snapshotInfo describes a snapshot of the Nickel DB and Calibre metadata files
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	SDCard  bool      `json:"sdCard"`
+	Files   []string  `json:"files"`
+}
+
+// snapshotFiles are the files, relative to the book root, that are
+// snapshotted along with the Nickel DB
+var snapshotFiles = []string{calibreMDfile, calibreMDjournal, calibreDIfile}
+
+// BackupBeforeWrite snapshots the Nickel DB and Calibre metadata files the
+// first time it is called in a session. Call it before changing anything on
+// the device. Nothing is written during a dry run, so no snapshot is taken.
+func (k *Kobo) BackupBeforeWrite() error {
+	if k.DryRun() {
+		return nil
+	}
+	k.backupOnce.Do(func() {
+		k.updateStatus("Backing up the Kobo database and metadata.calibre", -1)
+		var s *snapshotInfo
+		if s, k.backupErr = k.createSnapshot(time.Now()); k.backupErr == nil {
+			log.Printf("BackupBeforeWrite: created snapshot %s", s.Name)
+		}
+	})
+	if k.backupErr != nil {
+		return fmt.Errorf("BackupBeforeWrite: %w", k.backupErr)
+	}
+	return nil
+}
+
+// createSnapshot creates a new snapshot, then removes the oldest snapshots
+func (k *Kobo) createSnapshot(now time.Time) (*snapshotInfo, error) {
+	s := &snapshotInfo{Name: now.UTC().Format(snapshotNameFormat), Created: now.UTC(), SDCard: k.UseSDCard}
+	dir := filepath.Join(k.DBRootDir, kuBackupDir, s.Name)
+	// The snapshot is built in a temporary directory, so an incomplete
+	// snapshot is never listed
+	tmpDir := dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, fmt.Errorf("createSnapshot: error creating snapshot directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err := os.Stat(filepath.Join(k.DBRootDir, koboDBpath)); err == nil {
+		if err = k.snapshotNickelDB(filepath.Join(tmpDir, filepath.Base(koboDBpath))); err != nil {
+			return nil, fmt.Errorf("createSnapshot: %w", err)
+		}
+		s.Files = append(s.Files, filepath.Base(koboDBpath))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("createSnapshot: %w", err)
+	}
+	for _, fn := range snapshotFiles {
+		copied, err := copyFile(filepath.Join(tmpDir, fn), filepath.Join(k.BKRootDir, fn))
+		if err != nil {
+			return nil, fmt.Errorf("createSnapshot: error backing up %s: %w", fn, err)
+		}
+		if copied {
+			s.Files = append(s.Files, fn)
+		}
+	}
+	info, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("createSnapshot: error encoding snapshot info: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(tmpDir, snapshotInfoFile), info, 0644); err != nil {
+		return nil, fmt.Errorf("createSnapshot: error writing snapshot info: %w", err)
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		return nil, fmt.Errorf("createSnapshot: error renaming snapshot directory: %w", err)
+	}
+	snapshots, err := k.listSnapshots()
+	if err != nil {
+		// The new snapshot is fine, the old ones will be removed next time
+		log.Print(err)
+		return s, nil
+	}
+	for _, old := range snapshots[min(len(snapshots), maxSnapshots):] {
+		if err = os.RemoveAll(filepath.Join(k.DBRootDir, kuBackupDir, old.Name)); err != nil {
+			log.Printf("createSnapshot: error removing snapshot %s: %v", old.Name, err)
+		}
+	}
+	return s, nil
+}
+
+// snapshotNickelDB copies the Nickel DB to dest
+func (k *Kobo) snapshotNickelDB(dest string) error {
+	nickelDB, err := k.openNickelDB(true)
+	if err != nil {
+		return fmt.Errorf("snapshotNickelDB: %w", err)
+	}
+	defer nickelDB.Close()
+	snapshotDB, err := sql.Open("sqlite3", "file:"+dest)
+	if err != nil {
+		return fmt.Errorf("snapshotNickelDB: sql open failed: %w", err)
+	}
+	defer snapshotDB.Close()
+	if err = copySQLite(snapshotDB, nickelDB); err != nil {
+		return fmt.Errorf("snapshotNickelDB: %w", err)
+	}
+	return nil
+}
+
+// restoreNickelDB copies the DB at src over the Nickel DB
+func (k *Kobo) restoreNickelDB(src string) error {
+	snapshotDB, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("restoreNickelDB: sql open failed: %w", err)
+	}
+	defer snapshotDB.Close()
+	nickelDB, err := k.openNickelDB(false)
+	if err != nil {
+		return fmt.Errorf("restoreNickelDB: %w", err)
+	}
+	defer nickelDB.Close()
+	if err = copySQLite(nickelDB, snapshotDB); err != nil {
+		return fmt.Errorf("restoreNickelDB: %w", err)
+	}
+	return nil
+}
+
+// listSnapshots gets the snapshots in the backup directory, newest first
+func (k *Kobo) listSnapshots() ([]snapshotInfo, error) {
+	snapshots := make([]snapshotInfo, 0)
+	backupDir := filepath.Join(k.DBRootDir, kuBackupDir)
+	entries, err := os.ReadDir(backupDir)
+	if os.IsNotExist(err) {
+		return snapshots, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listSnapshots: error reading backup directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		var s snapshotInfo
+		data, err := os.ReadFile(filepath.Join(backupDir, e.Name(), snapshotInfoFile))
+		if err == nil {
+			err = json.Unmarshal(data, &s)
+		}
+		if err != nil || s.Name != e.Name() {
+			log.Printf("listSnapshots: skipping %s: invalid snapshot", e.Name())
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name > snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+// restoreSnapshot replaces the Nickel DB and Calibre metadata files with the
+// named snapshot. A metadata journal newer than the snapshot is removed.
+func (k *Kobo) restoreSnapshot(name string) error {
+	snapshots, err := k.listSnapshots()
+	if err != nil {
+		return fmt.Errorf("restoreSnapshot: %w", err)
+	}
+	var s *snapshotInfo
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			s = &snapshots[i]
+			break
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("restoreSnapshot: snapshot '%s' not found", name)
+	}
+	if s.SDCard != k.UseSDCard {
+		return fmt.Errorf("restoreSnapshot: snapshot '%s' is of a different storage location", name)
+	}
+	dir := filepath.Join(k.DBRootDir, kuBackupDir, s.Name)
+	if dbFile := filepath.Base(koboDBpath); util.StringSliceContains(s.Files, dbFile) {
+		if err = k.restoreNickelDB(filepath.Join(dir, dbFile)); err != nil {
+			return fmt.Errorf("restoreSnapshot: %w", err)
+		}
+	}
+	for _, fn := range snapshotFiles {
+		dest := filepath.Join(k.BKRootDir, fn)
+		if !util.StringSliceContains(s.Files, fn) {
+			if err = os.Remove(dest); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("restoreSnapshot: error removing %s: %w", fn, err)
+			}
+			continue
+		}
+		err = util.WriteFileAtomic(dest, true, func(w io.Writer) error {
+			f, err := os.Open(filepath.Join(dir, fn))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("restoreSnapshot: error restoring %s: %w", fn, err)
+		}
+	}
+	log.Printf("restoreSnapshot: restored snapshot %s", s.Name)
+	return nil
+}
+
+// copySQLite copies the src database over dest, using SQLite's online
+// backup API, which is safe to use while Nickel has the database open
+func copySQLite(dest, src *sql.DB) error {
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("copySQLite: %w", err)
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("copySQLite: %w", err)
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			d, dOK := dc.(*sqlite3.SQLiteConn)
+			s, sOK := sc.(*sqlite3.SQLiteConn)
+			if !dOK || !sOK {
+				return fmt.Errorf("copySQLite: not an SQLite connection")
+			}
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return fmt.Errorf("copySQLite: error starting backup: %w", err)
+			}
+			_, err = b.Step(-1)
+			if finishErr := b.Finish(); err == nil {
+				err = finishErr
+			}
+			if err != nil {
+				return fmt.Errorf("copySQLite: error copying database: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// copyFile copies src to dest, if src exists. Whether it was copied is returned.
+func copyFile(dest, src string) (bool, error) {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil, err
+}
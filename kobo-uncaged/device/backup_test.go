@@ -0,0 +1,76 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, db := newTestNickelDB(t, `CREATE TABLE content (ContentID TEXT, Title TEXT); INSERT INTO content VALUES ('a', 'Before');`)
+	k := &Kobo{DBRootDir: dir, BKRootDir: dir}
+	mdPath := filepath.Join(dir, calibreMDfile)
+	err := os.WriteFile(mdPath, []byte(`[{"title": "Before"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.BackupBeforeWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first write of a session takes a snapshot
+	if err = k.BackupBeforeWrite(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := k.listSnapshots()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("listSnapshots() = %v, %v, want one snapshot", snapshots, err)
+	}
+	if want := []string{filepath.Base(koboDBpath), calibreMDfile}; len(snapshots[0].Files) != len(want) {
+		t.Errorf("snapshot files = %v, want %v", snapshots[0].Files, want)
+	}
+
+	if _, err = db.Exec(`UPDATE content SET Title='After';`); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(mdPath, []byte(`[{"title": "After"}]`), 0644)
+	os.WriteFile(filepath.Join(dir, calibreMDjournal), []byte(`{"op":"delete","lpath":"a.epub"}`), 0644)
+	if err = k.restoreSnapshot(snapshots[0].Name); err != nil {
+		t.Fatal(err)
+	}
+	var title string
+	if err = db.QueryRow(`SELECT Title FROM content WHERE ContentID='a';`).Scan(&title); err != nil || title != "Before" {
+		t.Errorf("restored title = %q, %v, want Before", title, err)
+	}
+	if data, _ := os.ReadFile(mdPath); string(data) != `[{"title": "Before"}]` {
+		t.Errorf("restored metadata.calibre = %s", data)
+	}
+	if _, err = os.Stat(filepath.Join(dir, calibreMDjournal)); !os.IsNotExist(err) {
+		t.Errorf("journal newer than the snapshot was not removed")
+	}
+
+	// Old snapshots are rotated out
+	for i := 1; i <= maxSnapshots; i++ {
+		if _, err = k.createSnapshot(time.Now().Add(time.Duration(i) * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if snapshots, _ = k.listSnapshots(); len(snapshots) != maxSnapshots {
+		t.Errorf("%d snapshots kept, want %d", len(snapshots), maxSnapshots)
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	k := &Kobo{}
+	if err := k.startSession(); err != nil {
+		t.Fatalf("startSession() = %v", err)
+	}
+	if err := k.startSession(); err == nil {
+		t.Errorf("session started twice")
+	}
+	k = &Kobo{snapshotRestored: true}
+	if err := k.startSession(); err == nil {
+		t.Errorf("session started after a snapshot was restored")
+	}
+}
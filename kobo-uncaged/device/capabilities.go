@@ -0,0 +1,123 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// capTables are the tables whose columns are checked for optional features,
+// or that refer to books by ContentID
+var capTables = []string{"content", "Bookmark", "Shelf", "ShelfContent", "volume_shortcovers",
+	"volume_tabs", "content_keys", "Event", "Activity"}
+
+// nickelCaps describes the Nickel DB schema and firmware of the device.
+// Optional columns and features are detected from the schema, rather than
+// assumed from the firmware version.
+type nickelCaps struct {
+	fw        firmwareVersion
+	dbVersion int
+	columns   map[string]map[string]bool
+}
+
+// readNickelCaps reads the DB version, and the columns of the tables used
+// by Kobo UNCaGED
+func readNickelCaps(db *sql.DB, fw firmwareVersion) (*nickelCaps, error) {
+	c := &nickelCaps{fw: fw, columns: make(map[string]map[string]bool)}
+	if err := db.QueryRow(`SELECT version FROM DbVersion;`).Scan(&c.dbVersion); err != nil {
+		return nil, fmt.Errorf("readNickelCaps: error getting DB version: %w", err)
+	}
+	for _, table := range capTables {
+		cols, err := tableColumns(db, table)
+		if err != nil {
+			return nil, fmt.Errorf("readNickelCaps: %w", err)
+		}
+		c.columns[table] = cols
+	}
+	return c, nil
+}
+
+// capabilities gets the capabilities of the Nickel DB, reading them from db
+// the first time it is called
+func (k *Kobo) capabilities(db *sql.DB) (*nickelCaps, error) {
+	if k.caps == nil {
+		caps, err := readNickelCaps(db, k.fw)
+		if err != nil {
+			return nil, fmt.Errorf("capabilities: %w", err)
+		}
+		log.Printf("Nickel DB version %d, firmware %s, SeriesID: %t, TimeSpentReading: %t, bookmark types: %t, shelf Id's: %t",
+			caps.dbVersion, caps.fw, caps.seriesID(), caps.timeSpentReading(), caps.bookmarkType(), caps.shelfID())
+		k.caps = caps
+	}
+	return k.caps, nil
+}
+
+// tableColumns returns the set of column names in table
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return nil, fmt.Errorf("tableColumns: error getting columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("tableColumns: row decoding error: %w", err)
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// hasColumn reports whether table has the column col
+func (c *nickelCaps) hasColumn(table, col string) bool {
+	return c.columns[table][col]
+}
+
+// seriesID reports whether books have a Kobo SeriesID, which groups
+// sideloaded books with store series (FW 4.20.14601 and later)
+func (c *nickelCaps) seriesID() bool {
+	return c.hasColumn("content", "SeriesID")
+}
+
+// timeSpentReading reports whether Nickel records the time spent reading a book
+func (c *nickelCaps) timeSpentReading() bool {
+	return c.hasColumn("content", "TimeSpentReading")
+}
+
+// timeSpentCol is the SQL expression selecting the time spent reading a book
+func (c *nickelCaps) timeSpentCol() string {
+	if c.timeSpentReading() {
+		return "TimeSpentReading"
+	}
+	return "0"
+}
+
+// bookmarkType reports whether bookmarks record whether they are a
+// highlight, note or dogear
+func (c *nickelCaps) bookmarkType() bool {
+	return c.hasColumn("Bookmark", "Type")
+}
+
+// shelfID reports whether collections need an Id when created
+func (c *nickelCaps) shelfID() bool {
+	return c.hasColumn("Shelf", "Id")
+}
+
+// filterRecord removes the fields table does not have from rec. The names
+// of the removed fields are returned.
+func (c *nickelCaps) filterRecord(table string, rec goqu.Record) []string {
+	var removed []string
+	for col := range rec {
+		if !c.hasColumn(table, col) {
+			delete(rec, col)
+			removed = append(removed, col)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
@@ -0,0 +1,34 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+func TestReadNickelCaps(t *testing.T) {
+	// An older schema: no SeriesID, SeriesNumberFloat or bookmark types, but shelves have Id's
+	_, db := newTestNickelDB(t, `CREATE TABLE DbVersion (version INTEGER); INSERT INTO DbVersion VALUES (150);
+		CREATE TABLE content (ContentID TEXT, Series TEXT, SeriesNumber TEXT, Subtitle TEXT, TimeSpentReading INT);
+		CREATE TABLE Bookmark (BookmarkID TEXT, VolumeID TEXT, Text TEXT);
+		CREATE TABLE Shelf (Id TEXT, Name TEXT);`)
+	caps, err := readNickelCaps(db, "4.19.14123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.dbVersion != 150 {
+		t.Errorf("dbVersion = %d, want 150", caps.dbVersion)
+	}
+	if caps.seriesID() || caps.bookmarkType() || !caps.timeSpentReading() || !caps.shelfID() {
+		t.Errorf("seriesID/bookmarkType/timeSpentReading/shelfID = %t/%t/%t/%t, want false/false/true/true",
+			caps.seriesID(), caps.bookmarkType(), caps.timeSpentReading(), caps.shelfID())
+	}
+	rec := goqu.Record{"Series": "S", "SeriesNumber": "1", "SeriesNumberFloat": 1.0, "SeriesID": "id", "Subtitle": nil}
+	if removed := caps.filterRecord("content", rec); !reflect.DeepEqual(removed, []string{"SeriesID", "SeriesNumberFloat"}) {
+		t.Errorf("filterRecord() removed %v, want [SeriesID SeriesNumberFloat]", removed)
+	}
+	if len(rec) != 3 {
+		t.Errorf("filtered record = %v, want Series, SeriesNumber and Subtitle", rec)
+	}
+}
@@ -0,0 +1,228 @@
+package device
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// kuShelvesFile records the collections created by Kobo UNCaGED. Only
+// these collections will have books removed, or be deleted when empty.
+const kuShelvesFile = ".adds/kobo-uncaged/config/ku_shelves.json"
+
+// bookCollections gets the collections a book belongs to, from the
+// Calibre field col.
+func bookCollections(md *uc.CalibreBookMeta, col string) []string {
+	var names []string
+	switch {
+	case col == "tags":
+		names = md.Tags
+	case col == "series":
+		if md.Series != nil {
+			names = []string{*md.Series}
+		}
+	case strings.HasPrefix(col, "#"):
+		cc, exists := md.UserMetadata[col]
+		if !exists {
+			break
+		}
+		switch v := cc.Value.(type) {
+		case string:
+			names = []string{v}
+		case []interface{}:
+			for _, n := range v {
+				if s, ok := n.(string); ok {
+					names = append(names, s)
+				}
+			}
+		}
+	}
+	collections := make([]string, 0, len(names))
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			collections = append(collections, n)
+		}
+	}
+	return collections
+}
+
+// updateCollections creates and refreshes Nickel collections (shelves) from
+// the Calibre field selected by the user. Only sideloaded books known to
+// Kobo UNCaGED are added to, or removed from, collections. It reports whether
+// any collection, or the books in it, changed.
+func (k *Kobo) updateCollections() (bool, error) {
+	libOpts, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]
+	if !exists || libOpts.CollectionsColumn == "" {
+		return false, nil
+	}
+	managed := make(map[string]bool)
+	if _, err := util.ReadJSON(filepath.Join(k.DBRootDir, kuShelvesFile), &managed); err != nil {
+		return false, fmt.Errorf("updateCollections: error reading managed collections: %w", err)
+	}
+	// Build the set of books each collection should contain
+	wanted := make(map[string]map[string]bool)
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		if m.Meta == nil {
+			return true
+		}
+		for _, name := range bookCollections(m.Meta, libOpts.CollectionsColumn) {
+			if wanted[name] == nil {
+				wanted[name] = make(map[string]bool)
+			}
+			wanted[name][cid] = true
+		}
+		return true
+	})
+	if err := k.BackupBeforeWrite(); err != nil {
+		return false, fmt.Errorf("updateCollections: %w", err)
+	}
+	nickelDB, err := k.openNickelDB(false)
+	if err != nil {
+		return false, fmt.Errorf("updateCollections: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return false, fmt.Errorf("updateCollections: %w", err)
+	}
+	tx, err := k.beginTx(nickelDB)
+	if err != nil {
+		return false, fmt.Errorf("updateCollections: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(nickelTimeFormat)
+
+	// Existing shelves, and whether they have been deleted
+	shelves, err := queryDeletedState(tx, `SELECT Name, _IsDeleted FROM Shelf;`)
+	if err != nil {
+		return false, fmt.Errorf("updateCollections: error getting shelves: %w", err)
+	}
+	shelfChanges := 0
+	for name := range wanted {
+		deleted, exists := shelves[name]
+		if !exists {
+			cols, vals := "CreationDate, InternalName, LastModified, Name, _IsDeleted, _IsVisible, _IsSynced", "?, ?, ?, ?, 'false', 'true', 'false'"
+			args := []interface{}{now, name, now, name}
+			if caps.shelfID() {
+				cols, vals = cols+", Id", vals+", ?"
+				args = append(args, uuid.New().String())
+			}
+			if _, err = tx.Exec(`INSERT INTO Shelf (`+cols+`) VALUES (`+vals+`);`, args...); err != nil {
+				return false, fmt.Errorf("updateCollections: error creating collection '%s': %w", name, err)
+			}
+			managed[name] = true
+			shelfChanges++
+		} else if deleted {
+			if _, err = tx.Exec(`UPDATE Shelf SET _IsDeleted='false', _IsSynced='false', LastModified=? WHERE Name=?;`, now, name); err != nil {
+				return false, fmt.Errorf("updateCollections: error restoring collection '%s': %w", name, err)
+			}
+			shelfChanges++
+		}
+	}
+
+	// Existing shelf contents for sideloaded books
+	rows, err := tx.Query(`SELECT ShelfName, ContentId, _IsDeleted FROM ShelfContent WHERE ContentId LIKE ?;`, string(k.ContentIDprefix)+"%")
+	if err != nil {
+		return false, fmt.Errorf("updateCollections: error getting collection contents: %w", err)
+	}
+	contents := make(map[string]map[string]bool)
+	for rows.Next() {
+		var shelf, cid string
+		var deleted *string
+		if err = rows.Scan(&shelf, &cid, &deleted); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("updateCollections: collection content decoding error: %w", err)
+		}
+		if contents[shelf] == nil {
+			contents[shelf] = make(map[string]bool)
+		}
+		contents[shelf][cid] = deleted != nil && *deleted == "true"
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, fmt.Errorf("updateCollections: collection content rows error: %w", err)
+	}
+	added, removed := 0, 0
+	for name, cids := range wanted {
+		for cid := range cids {
+			deleted, exists := contents[name][cid]
+			if !exists {
+				_, err = tx.Exec(`INSERT INTO ShelfContent (ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced) VALUES (?, ?, ?, 'false', 'false');`, name, cid, now)
+			} else if deleted {
+				_, err = tx.Exec(`UPDATE ShelfContent SET _IsDeleted='false', _IsSynced='false', DateModified=? WHERE ShelfName=? AND ContentId=?;`, now, name, cid)
+			} else {
+				continue
+			}
+			if err != nil {
+				return false, fmt.Errorf("updateCollections: error adding book to collection '%s': %w", name, err)
+			}
+			added++
+		}
+	}
+	// Remove books that no longer belong in the collections we manage
+	for name := range managed {
+		for cid, deleted := range contents[name] {
+			if _, known := k.Metadata.Get(cid); deleted || !known || wanted[name][cid] {
+				continue
+			}
+			if _, err = tx.Exec(`UPDATE ShelfContent SET _IsDeleted='true', _IsSynced='false', DateModified=? WHERE ShelfName=? AND ContentId=?;`, now, name, cid); err != nil {
+				return false, fmt.Errorf("updateCollections: error removing book from collection '%s': %w", name, err)
+			}
+			removed++
+		}
+	}
+	if libOpts.RemoveEmptyCollections {
+		for name := range managed {
+			var count int
+			if err = tx.QueryRow(`SELECT COUNT(1) FROM ShelfContent WHERE ShelfName=? AND _IsDeleted<>'true';`, name).Scan(&count); err != nil {
+				return false, fmt.Errorf("updateCollections: error counting books in collection '%s': %w", name, err)
+			}
+			if count > 0 {
+				continue
+			}
+			if _, err = tx.Exec(`UPDATE Shelf SET _IsDeleted='true', _IsSynced='false', LastModified=? WHERE Name=?;`, now, name); err != nil {
+				return false, fmt.Errorf("updateCollections: error removing collection '%s': %w", name, err)
+			}
+			delete(managed, name)
+			shelfChanges++
+		}
+	}
+	if err = k.commitTx(tx, fmt.Sprintf("add %d book(s) to collections and remove %d", added, removed)); err != nil {
+		return false, fmt.Errorf("updateCollections: failed to commit transaction: %w", err)
+	}
+	log.Printf("updateCollections: %d books added to collections, %d removed", added, removed)
+	changed := added+removed+shelfChanges > 0
+	if k.DryRun() {
+		return changed, nil
+	}
+	if err = util.WriteJSON(filepath.Join(k.DBRootDir, kuShelvesFile), managed); err != nil {
+		return false, fmt.Errorf("updateCollections: error saving managed collections: %w", err)
+	}
+	return changed, nil
+}
+
+// queryDeletedState runs query, which must select a name and an _IsDeleted
+// column, and returns whether each name is deleted.
+func queryDeletedState(tx *nickelTx, query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	state := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var deleted *string
+		if err = rows.Scan(&name, &deleted); err != nil {
+			return nil, err
+		}
+		state[name] = deleted != nil && *deleted == "true"
+	}
+	return state, rows.Err()
+}
@@ -0,0 +1,41 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestUpdateCollections(t *testing.T) {
+	dir, db := newTestNickelDB(t, `CREATE TABLE DbVersion (version INTEGER); INSERT INTO DbVersion VALUES (170);
+		CREATE TABLE Shelf (CreationDate TEXT, InternalName TEXT, LastModified TEXT, Name TEXT, _IsDeleted TEXT, _IsVisible TEXT, _IsSynced TEXT);
+		CREATE TABLE ShelfContent (ShelfName TEXT, ContentId TEXT, DateModified TEXT, _IsDeleted TEXT, _IsSynced TEXT);`)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, kuShelvesFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	k := &Kobo{
+		DBRootDir:       dir,
+		BKRootDir:       dir,
+		ContentIDprefix: onboardPrefix,
+		Metadata:        NewMetadataStore(1),
+		KuConfig: &KuOptions{LibOptions: map[string]KuLibOptions{
+			"lib": {CollectionsColumn: "tags"},
+		}},
+		LibInfo: uc.CalibreLibraryInfo{LibraryUUID: "lib"},
+	}
+	k.Metadata.set(string(onboardPrefix)+"a.epub", BookMeta{Meta: &uc.CalibreBookMeta{Lpath: "a.epub", Tags: []string{"Fiction"}}})
+
+	if changed, err := k.updateCollections(); err != nil || !changed {
+		t.Fatalf("updateCollections() = %t, %v, want true, nil", changed, err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM ShelfContent WHERE ShelfName='Fiction';`).Scan(&count); err != nil || count != 1 {
+		t.Errorf("books in Fiction = %d, %v, want 1", count, err)
+	}
+	// Nothing to do the next session, so no rescan is needed
+	if changed, err := k.updateCollections(); err != nil || changed {
+		t.Errorf("updateCollections() = %t, %v, want false, nil", changed, err)
+	}
+}
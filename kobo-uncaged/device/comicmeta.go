@@ -0,0 +1,136 @@
+package device
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nwaples/rardecode"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// comicInfoFile is the name of the metadata file in comic archives
+const comicInfoFile = "comicinfo.xml"
+
+// comicInfoMaxSize limits the size of ComicInfo.xml files that are read
+const comicInfoMaxSize = 1 << 20
+
+// comicInfo holds the ComicInfo.xml fields that map to Calibre metadata
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Summary     string `xml:"Summary"`
+	Year        int    `xml:"Year"`
+	Month       int    `xml:"Month"`
+	Day         int    `xml:"Day"`
+	Writer      string `xml:"Writer"`
+	Publisher   string `xml:"Publisher"`
+	Genre       string `xml:"Genre"`
+	Tags        string `xml:"Tags"`
+	LanguageISO string `xml:"LanguageISO"`
+	GTIN        string `xml:"GTIN"`
+}
+
+// readCBZMeta reads ComicInfo.xml from a CBZ
+func readCBZMeta(bkPath string, md *uc.CalibreBookMeta) error {
+	zr, err := zip.OpenReader(bkPath)
+	if err != nil {
+		return fmt.Errorf("readCBZMeta: error opening cbz: %w", err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if strings.ToLower(path.Base(f.Name)) != comicInfoFile || f.UncompressedSize64 > comicInfoMaxSize {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("readCBZMeta: error opening ComicInfo.xml: %w", err)
+		}
+		defer rc.Close()
+		if err = applyComicInfo(rc, md); err != nil {
+			return fmt.Errorf("readCBZMeta: %w", err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// readCBRMeta reads ComicInfo.xml from a CBR
+func readCBRMeta(bkPath string, md *uc.CalibreBookMeta) error {
+	rc, err := rardecode.OpenReader(bkPath, "")
+	if err != nil {
+		return fmt.Errorf("readCBRMeta: error opening cbr: %w", err)
+	}
+	defer rc.Close()
+	for {
+		h, err := rc.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("readCBRMeta: error reading cbr: %w", err)
+		}
+		if h.IsDir || strings.ToLower(path.Base(h.Name)) != comicInfoFile || h.UnPackedSize > comicInfoMaxSize {
+			continue
+		}
+		if err = applyComicInfo(rc, md); err != nil {
+			return fmt.Errorf("readCBRMeta: %w", err)
+		}
+		return nil
+	}
+}
+
+// applyComicInfo fills book metadata from a ComicInfo.xml file
+func applyComicInfo(r io.Reader, md *uc.CalibreBookMeta) error {
+	var ci comicInfo
+	if err := xml.NewDecoder(io.LimitReader(r, comicInfoMaxSize)).Decode(&ci); err != nil {
+		return fmt.Errorf("applyComicInfo: error decoding ComicInfo.xml: %w", err)
+	}
+	if ci.Title = strings.TrimSpace(ci.Title); ci.Title != "" {
+		md.Title = ci.Title
+	}
+	if ci.Series = strings.TrimSpace(ci.Series); ci.Series != "" {
+		md.Series = &ci.Series
+		if index, err := strconv.ParseFloat(strings.TrimSpace(ci.Number), 64); err == nil {
+			md.SeriesIndex = &index
+		}
+		if md.Title == "" && ci.Number != "" {
+			md.Title = ci.Series + " #" + strings.TrimSpace(ci.Number)
+		}
+	}
+	if ci.Summary = strings.TrimSpace(ci.Summary); ci.Summary != "" {
+		md.Comments = &ci.Summary
+	}
+	if a := splitNames(ci.Writer, ",;"); len(a) > 0 {
+		md.Authors = a
+	}
+	if ci.Publisher = strings.TrimSpace(ci.Publisher); ci.Publisher != "" {
+		md.Publisher = &ci.Publisher
+	}
+	if tags := append(splitNames(ci.Genre, ",;"), splitNames(ci.Tags, ",;")...); len(tags) > 0 {
+		md.Tags = tags
+	}
+	if ci.LanguageISO = strings.TrimSpace(ci.LanguageISO); ci.LanguageISO != "" {
+		md.Languages = []string{ci.LanguageISO}
+	}
+	if ci.Year > 0 {
+		month, day := time.Month(ci.Month), ci.Day
+		if month < time.January || month > time.December {
+			month = time.January
+		}
+		if day < 1 || day > 31 {
+			day = 1
+		}
+		pd := uc.ConvertTime(time.Date(ci.Year, month, day, 0, 0, 0, 0, time.UTC))
+		md.Pubdate = &pd
+	}
+	if gtin := strings.ReplaceAll(strings.TrimSpace(ci.GTIN), "-", ""); len(gtin) == 13 && (strings.HasPrefix(gtin, "978") || strings.HasPrefix(gtin, "979")) {
+		setIdentifier(md, "isbn", gtin)
+	}
+	return nil
+}
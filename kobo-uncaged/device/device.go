@@ -1,6 +1,7 @@
 package device
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
@@ -8,17 +9,16 @@ import (
 	"html"
 	"image"
 	"image/jpeg"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bamiaux/rez"
-	"github.com/doug-martin/goqu/v9"
 	"github.com/godbus/dbus/v5"
 
 	// Lets gpqu emit SQLite3 compatible code
@@ -36,12 +36,11 @@ const koboVersPath = ".kobo/version"
 const calibreMDfile = "metadata.calibre"
 const calibreDIfile = "driveinfo.calibre"
 const kuUpdatedMDfile = "metadata_update.kobouc"
-const kuUpdatedSQL = ".adds/kobo-uncaged/updated-md.sql"
-const kuBookReplaceSQL = ".adds/kobo-uncaged/replace-book.sql"
 const kuPassCache = ".adds/kobo-uncaged/.ku_pwcache.json"
 const kuConfigFile = ".adds/kobo-uncaged/config/kuconfig.json"
 const ndbInterface = "com.github.shermp.nickeldbus"
 const viewChangedName = ndbInterface + ".ndbViewChanged"
+const rescanDoneName = ndbInterface + ".pfmDoneProcessing"
 
 const onboardPrefix cidPrefix = "file:///mnt/onboard/"
 const sdPrefix cidPrefix = "file:///mnt/sd/"
@@ -56,7 +55,7 @@ func isBrowserViewSignal(vs *dbus.Signal) (bool, error) {
 }
 
 // New creates a Kobo object, ready for use
-func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers string) (*Kobo, error) {
+func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB, dryRun bool, vers string) (*Kobo, error) {
 	var err error
 	k := &Kobo{}
 	k.DBRootDir = dbRootDir
@@ -79,6 +78,10 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	}
 	//k.Passwords = newUncagedPassword(k.KuConfig.PasswordList)
 	k.SeriesIDMap = make(map[string]string, 0)
+	k.replacedBooks = make(map[string]int)
+	k.deletedBooks = make(map[string]deletedBook)
+	k.receivedBooks = make(map[string]receivedBook)
+	k.chapterRemaps = make(map[string]chapterRemap)
 	k.PassCache = make(calPassCache)
 	log.Println("Getting Kobo Info")
 	if err = k.getKoboInfo(); err != nil {
@@ -146,18 +149,26 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 			k.ndbObj.Call(ndbInterface+".mwcToast", 0, 3000, "Kobo UNCaGED: Browser did not open after timeout")
 			return nil, fmt.Errorf("New: timeout waiting for browser to open")
 		}
-		// Exit if we encounter a view changed signal from Nickel away from 'N3BrowserView'
+		// Exit if we encounter a view changed signal from Nickel away from 'N3BrowserView'.
+		// The end of library rescans started by rescanLibrary is also passed on.
 		go func() {
 			for v := range k.viewSignal {
-				if isBV, err := isBrowserViewSignal(v); err == nil && !isBV {
+				if v.Name == rescanDoneName {
+					k.rescanFinished()
+					continue
+				}
+				if isBV, err := isBrowserViewSignal(v); err == nil && !isBV && k.BrowserOpen {
 					k.BrowserOpen = false
 					k.ndbObj.Call(ndbInterface+".mwcToast", 0, 3000, "Browser closed. Kobo UNCaGED exiting")
-					if k.UCExitChan != nil {
-						k.UCExitChan <- true
-					} else {
-						k.exitChan <- true
-					}
-					return
+					// UNCaGED may have already exited, so don't block signal handling
+					// waiting for it
+					go func() {
+						if k.UCExitChan != nil {
+							k.UCExitChan <- true
+						} else {
+							k.exitChan <- true
+						}
+					}()
 				}
 			}
 		}()
@@ -169,12 +180,28 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 		}
 		k.KuConfig = &opt.Opts
 		k.KuConfig.Thumbnail.SetRezFilter()
+		k.KuConfig.SeriesMatching.Validate()
 		if err = k.SaveUserOptions(); err != nil {
 			return nil, fmt.Errorf("New: failed to save updated config options to file: %w", err)
 		}
+		if dryRun || k.KuConfig.DryRun {
+			log.Println("Dry run: no changes will be made to the device")
+			k.dryRun = &dryRunLog{}
+		}
 	case <-k.exitChan:
 		// Give the client time to request and render the final exit page before quitting
 		time.Sleep(500 * time.Millisecond)
+		// Nickel keeps using the library it has loaded until it restarts, and
+		// would write it back over a restored snapshot
+		k.sessionMu.Lock()
+		restored := k.snapshotRestored
+		k.sessionMu.Unlock()
+		if restored && k.useNDB {
+			log.Println("Restarting the Kobo to load the restored snapshot")
+			if err = k.ndbObj.Call(ndbInterface+".pwrReboot", 0).Err; err != nil {
+				log.Printf("New: error restarting the Kobo: %v", err)
+			}
+		}
 		return nil, nil
 	}
 	k.WebSend(WebMsg{ShowMessage: "Gathering information about your Kobo", Progress: -1})
@@ -182,6 +209,10 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	if err = k.loadDeviceInfo(); err != nil {
 		return nil, fmt.Errorf("New: failed to load device info: %w", err)
 	}
+	if err = k.removePartialBooks(); err != nil {
+		// They are harmless, and will be overwritten if the book is sent again
+		log.Print(err)
+	}
 	k.WebSend(WebMsg{ShowMessage: "Reading Metadata", Progress: -1})
 	log.Println("Reading Metadata")
 	if err = k.readMDfile(); err != nil {
@@ -193,6 +224,7 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	if err = k.readPassCache(); err != nil {
 		log.Print(err)
 	}
+	k.warnRecovered()
 	select {
 	case <-k.exitChan:
 		return nil, fmt.Errorf("New: browser exited prematurely")
@@ -272,6 +304,7 @@ func (k *Kobo) getUserOptions() error {
 	}
 	opts.Thumbnail.Validate()
 	opts.Thumbnail.SetRezFilter()
+	opts.SeriesMatching.Validate()
 	k.KuConfig = opts
 	return nil
 }
@@ -280,26 +313,51 @@ func (k *Kobo) SaveUserOptions() error {
 	return util.WriteJSON(path.Join(k.DBRootDir, kuConfigFile), k.KuConfig)
 }
 
-// UpdateIfExists updates onboard metadata if it exists in the Nickel database
-func (k *Kobo) UpdateIfExists(cID string, len int) error {
-	var err error
-	if _, exists := k.MetadataMap[cID]; exists {
-		if k.MetadataMap[cID].Meta.Size == len {
-			return nil
-		}
-		if k.replSQLWriter == nil {
-			if k.replSQLWriter, err = newSQLWriter(filepath.Join(k.BKRootDir, kuBookReplaceSQL)); err != nil {
-				return err
+// UpdateIfExists updates onboard metadata if it exists in the Nickel database.
+// Books whose digest matches the last copy received are unchanged. Books
+// received before digests were recorded are compared by size.
+func (k *Kobo) UpdateIfExists(cID string, len int, digest string) error {
+	if m, exists := k.Metadata.Get(cID); exists {
+		if m.sha256 != "" && digest != "" {
+			if m.sha256 == digest {
+				return nil
 			}
+		} else if m.Meta != nil && m.Meta.Size == len {
+			return nil
 		}
-		dialect := goqu.Dialect("sqlite3")
-		ds := dialect.Update("content").Set(goqu.Record{"___FileSize": len}).Where(goqu.Ex{"ContentID": cID, "ContentType": 6})
-		sqlStr, _, _ := ds.ToSQL()
-		k.replSQLWriter.writeQuery(sqlStr)
+		k.queueReplacedBook(cID, m, len)
 	}
 	return nil
 }
 
+// queueReplacedBook queues the filesize of a replaced book to be written to
+// the DB before Nickel rescans the library. Nickel only re-imports a book whose
+// size differs from the one in the DB, so a replacement the same size as the
+// previous copy is given a size that differs from the file.
+func (k *Kobo) queueReplacedBook(cID string, m BookMeta, size int) {
+	if m.Meta != nil && m.Meta.Size == size {
+		size++
+	}
+	k.replacedBooks[cID] = size
+}
+
+// BookLastModified gets the last modified time of a book to report to
+// Calibre. Books without one in their metadata use the modification time of
+// the book file, which, unlike the current time, is the same every session.
+func (k *Kobo) BookLastModified(md *uc.CalibreBookMeta) time.Time {
+	if t := md.LastModified.GetTime(); t != nil {
+		return *t
+	}
+	root := k.BKRootDir
+	if k.IsStoreBook(md.Lpath) {
+		root = k.DBRootDir
+	}
+	if fi, err := os.Stat(filepath.Join(root, md.Lpath)); err == nil {
+		return fi.ModTime().UTC()
+	}
+	return time.Now()
+}
+
 func (k *Kobo) getKoboInfo() error {
 	_, vers, id, err := kobo.ParseKoboVersion(k.DBRootDir)
 	if err != nil {
@@ -403,25 +461,37 @@ func (k *Kobo) readEpubMeta(contentID string, md *uc.CalibreBookMeta) error {
 	return nil
 }
 
+// uuidSampleSize is how much of the start and end of a book file is hashed
+// to derive its UUID
+const uuidSampleSize = 64 * 1024
+
+// stableBookUUID derives a UUID for a book that has none, so the book keeps
+// the same identity in Calibre across sessions. It is a name based UUID of the
+// ContentID, the file size, and the start and end of the file. Sampling keeps
+// large PDFs and comics fast, while still changing when the book is replaced.
+func stableBookUUID(contentID, bkPath string) string {
+	h := sha256.New()
+	if f, err := os.Open(bkPath); err == nil {
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil {
+			fmt.Fprintf(h, "%d", fi.Size())
+			io.Copy(h, io.NewSectionReader(f, 0, uuidSampleSize))
+			if tail := max(fi.Size()-uuidSampleSize, uuidSampleSize); tail < fi.Size() {
+				io.Copy(h, io.NewSectionReader(f, tail, fi.Size()-tail))
+			}
+		}
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, append([]byte(contentID), h.Sum(nil)...)).String()
+}
+
 func (k *Kobo) readMDfile() error {
 	var err error
 	var nickelDB *sql.DB
-	dsn := "file:" + filepath.Join(k.DBRootDir, koboDBpath) + "?_timeout=2000&_journal=WAL&mode=ro&_mutex=full&_sync=NORMAL"
-	if nickelDB, err = sql.Open("sqlite3", dsn); err != nil {
-		return fmt.Errorf("openNickelDB: sql open failed: %w", err)
+	if nickelDB, err = k.openNickelDB(true); err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
 	}
 	defer nickelDB.Close()
-	var (
-		dbCID        string
-		dbTitle      *string
-		dbAttr       *string
-		dbDesc       *string
-		dbPublisher  *string
-		dbSeries     *string
-		dbbSeriesNum *string
-		dbMimeType   string
-		dbFileSize   int
-	)
+	var dbCID string
 	queryFrom := ` FROM content
 		WHERE ContentType=6
 		AND MimeType NOT LIKE 'image%%'
@@ -439,101 +509,174 @@ func (k *Kobo) readMDfile() error {
 	}
 	// There will be at most bkCount metadata records, but let's allocate an extra 10% to give
 	// a buffer when adding books later.
-	k.MetadataMap = make(map[string]BookMeta, int(float64(bkCount)*1.1))
-	// Get a list of valid contentID's from DB
+	k.Metadata = NewMetadataStore(int(float64(bkCount) * 1.1))
+	k.unmatchedMD = make(map[string]json.RawMessage)
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	// TimeSpentReading is not present in older firmware
+	timeSpentCol := caps.timeSpentCol()
+	// Get a list of valid contentID's, and their reading state from DB
 	k.DebugLogPrintf("Getting list of ContentID's from DB")
-	cidRows, err := nickelDB.Query(`SELECT ContentID`+queryFrom, cidLike)
+	cidRows, err := nickelDB.Query(`SELECT ContentID, ReadStatus, ___PercentRead, DateLastRead, `+timeSpentCol+queryFrom, cidLike)
 	if err != nil {
 		return fmt.Errorf("readMDfile: error getting book rows: %w", err)
 	}
 	defer cidRows.Close()
 	for cidRows.Next() {
-		if err = cidRows.Scan(&dbCID); err != nil {
+		var rs readingState
+		var dbReadStatus, dbPercentRead, dbTimeSpent *int
+		var dbLastRead *string
+		if err = cidRows.Scan(&dbCID, &dbReadStatus, &dbPercentRead, &dbLastRead, &dbTimeSpent); err != nil {
 			return fmt.Errorf("readMDfile: ContentID row decoding error: %w", err)
 		}
-		k.MetadataMap[dbCID] = BookMeta{}
+		if dbReadStatus != nil {
+			rs.readStatus = *dbReadStatus
+		}
+		if dbPercentRead != nil {
+			rs.percentRead = *dbPercentRead
+		}
+		if dbTimeSpent != nil {
+			rs.timeSpent = *dbTimeSpent
+		}
+		rs.lastRead = parseNickelTime(dbLastRead)
+		k.Metadata.set(dbCID, BookMeta{reading: &rs})
 	}
 	if err = cidRows.Err(); err != nil {
 		return fmt.Errorf("readMDfile: cidRows error: %w", err)
 	}
+	// Store books are only ever on the internal storage
+	if k.KuConfig.ShowStoreBooks && !k.UseSDCard {
+		k.DebugLogPrintf("Getting store books from DB")
+		if err = k.readStoreBooks(nickelDB, timeSpentCol); err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
+		}
+	}
+	// Highlights and notes, to be sent to Calibre
+	k.DebugLogPrintf("Getting annotations from DB")
+	annotations, err := readAnnotations(nickelDB, caps, cidLike)
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	for cid, a := range annotations {
+		if m, ok := k.Metadata.Get(cid); ok {
+			m.annotations = a
+			k.Metadata.set(cid, m)
+		}
+	}
 	// Now stream decode the metadata.calibre JSON file
 	k.DebugLogPrintf("Reading metadata.calibre")
-	f, err := util.GetFileRead(filepath.Join(k.BKRootDir, calibreMDfile))
+	_, err = util.ReadJSONStream(filepath.Join(k.BKRootDir, calibreMDfile), k.decodeMDfile)
 	if err != nil {
 		return fmt.Errorf("readMDfile: error reading calibre.metadata: %w", err)
 	}
-	defer f.Close()
-	if f != nil {
-		dec := json.NewDecoder(f)
-		t, err := dec.Token()
-		if err != nil {
-			return fmt.Errorf("readMDfile: error getting first json token")
-		} else if d, ok := t.(json.Delim); !ok || d.String() != "[" {
-			return fmt.Errorf("readMDfile: unexpected first JSON token. '[' expected")
-		}
-		for dec.More() {
-			var md uc.CalibreBookMeta
-			if err = dec.Decode(&md); err != nil {
-				return fmt.Errorf("readMDfile: error decoding JSON value: %w", err)
-			}
-			cid := util.LpathToContentID(md.Lpath, string(k.ContentIDprefix))
-			if m, ok := k.MetadataMap[cid]; ok {
-				m.Meta = &md
-				k.MetadataMap[cid] = m
-			}
-		}
-		// Not bothering to finish reading tokens, we don't care about what's left
+	// A journal left over from a previous session means Kobo UNCaGED didn't exit
+	// cleanly. Apply its changes, then compact it once all metadata is loaded.
+	replayed, err := k.replayMDjournal()
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
 	}
-	dbMetaNotReqCount := 0
 	k.DebugLogPrintf("Reading metadata from DB and ebook file where required")
-	// Get metadata from DB for books that have no entries in the cache
-	for cid, m := range k.MetadataMap {
-		if m.Meta != nil {
-			dbMetaNotReqCount++
-			continue
+	dbMeta, err := k.readDBBookMeta(nickelDB, queryFrom, cidLike)
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	k.loadUncachedMeta(dbMeta)
+	k.DebugLogPrintf("Skipped parsing book files for %d of %d books", k.Metadata.Len()-len(dbMeta), k.Metadata.Len())
+	if replayed {
+		if err = k.CompactMDfile(); err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
 		}
-		var bkMD uc.CalibreBookMeta
-		k.readEpubMeta(cid, &bkMD)
-		if err = nickelDB.QueryRow(`SELECT ContentID, Title, Attribution, Description, Publisher, Series, SeriesNumber, MimeType, ___FileSize`+queryFrom,
-			cid).Scan(&dbCID, &dbTitle, &dbAttr, &dbDesc, &dbPublisher, &dbSeries, &dbbSeriesNum, &dbMimeType, &dbFileSize); err != nil {
-			return fmt.Errorf("readMDfile: error getting metadata for %s: %w", cid, err)
-		}
-		bkMD.Lpath = util.ContentIDtoLpath(cid, string(k.ContentIDprefix))
-		bkMD.Comments, bkMD.Publisher, bkMD.Series = dbDesc, dbPublisher, dbSeries
-		if dbTitle != nil {
-			bkMD.Title = *dbTitle
-		}
-		if dbbSeriesNum != nil {
-			index, err := strconv.ParseFloat(*dbbSeriesNum, 64)
-			if err == nil {
-				bkMD.SeriesIndex = &index
-			}
+	}
+	// Sort out books where the files, Nickel DB and metadata cache disagree.
+	// It isn't worth failing the session over.
+	if _, err = k.ReconcileBooks(); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+// decodeMDfile decodes the metadata.calibre JSON array, one record at a time.
+// If decoding fails, any metadata set from the file is removed again, so the
+// backup can be tried instead.
+func (k *Kobo) decodeMDfile(dec *json.Decoder) (err error) {
+	defer func() {
+		if err != nil {
+			k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+				m.Meta = nil
+				k.Metadata.set(cid, m)
+				return true
+			})
+			k.unmatchedMD = make(map[string]json.RawMessage)
 		}
-		if dbAttr != nil {
-			bkMD.Authors = strings.Split(*dbAttr, ",")
-			for i := range bkMD.Authors {
-				bkMD.Authors[i] = strings.TrimSpace(bkMD.Authors[i])
-			}
+	}()
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("decodeMDfile: error getting first json token: %w", err)
+	} else if d, ok := t.(json.Delim); !ok || d.String() != "[" {
+		return fmt.Errorf("decodeMDfile: unexpected first JSON token. '[' expected")
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return fmt.Errorf("decodeMDfile: error decoding JSON value: %w", err)
 		}
-		if bkMD.UUID == "" {
-			uuidV4, _ := uuid.NewRandom()
-			bkMD.UUID = uuidV4.String()
+		rec, err := decodeMDrecord(raw)
+		if err != nil {
+			return fmt.Errorf("decodeMDfile: %w", err)
+		}
+		md := rec.CalibreBookMeta
+		cid := util.LpathToContentID(md.Lpath, string(k.ContentIDprefix))
+		if m, ok := k.Metadata.Get(cid); ok {
+			m.Meta, m.sha256 = md, rec.SHA256
+			k.Metadata.set(cid, m)
+		} else if md.Lpath != "" {
+			// Not (yet) in the Nickel DB. Keep the record as is, so it isn't lost
+			k.unmatchedMD[md.Lpath] = raw
 		}
-		m.Meta = &bkMD
-		k.MetadataMap[cid] = m
 	}
-	k.DebugLogPrintf("Skipped parsing epub/kepub for %d of %d books", dbMetaNotReqCount, len(k.MetadataMap))
-	return err
+	// A truncated file may end cleanly after a record, so check for the closing bracket
+	if t, err = dec.Token(); err != nil {
+		return fmt.Errorf("decodeMDfile: error getting last json token: %w", err)
+	} else if d, ok := t.(json.Delim); !ok || d.String() != "]" {
+		return fmt.Errorf("decodeMDfile: unexpected last JSON token. ']' expected")
+	}
+	return nil
+}
+
+// decodeMDrecord decodes a metadata.calibre record
+func decodeMDrecord(raw []byte) (mdRecord, error) {
+	rec := mdRecord{CalibreBookMeta: &uc.CalibreBookMeta{}}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return rec, fmt.Errorf("decodeMDrecord: error decoding metadata: %w", err)
+	}
+	return rec, nil
 }
 
 // WriteMDfile writes metadata to file
 func (k *Kobo) WriteMDfile() error {
-	var n int
 	var err error
-	metadata := make([]*uc.CalibreBookMeta, len(k.MetadataMap))
-	for _, md := range k.MetadataMap {
-		metadata[n] = md.Meta
-		n++
+	metadata := make([]interface{}, 0, k.Metadata.Len()+len(k.unmatchedMD))
+	k.Metadata.Iterate(func(cid string, md BookMeta) bool {
+		metadata = append(metadata, mdRecord{CalibreBookMeta: md.Meta, SHA256: md.sha256})
+		return true
+	})
+	// Records for books not in the Nickel DB are written back unchanged, unless
+	// a book has since been added with the same lpath
+	for lpath, raw := range k.unmatchedMD {
+		if _, exists := k.Metadata.Get(util.LpathToContentID(lpath, string(k.ContentIDprefix))); exists {
+			delete(k.unmatchedMD, lpath)
+			continue
+		}
+		metadata = append(metadata, raw)
+	}
+	if k.DryRun() {
+		k.DryRunf("would write %s with %d record(s)", calibreMDfile, len(metadata))
+		return nil
+	}
+	if err = k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("WriteMDfile: %w", err)
 	}
 	if err = util.WriteJSON(filepath.Join(k.BKRootDir, calibreMDfile), metadata); err != nil {
 		err = fmt.Errorf("WriteMDfile: %w", err)
@@ -541,6 +684,41 @@ func (k *Kobo) WriteMDfile() error {
 	return err
 }
 
+// reconcileUnmatchedMD moves metadata records for books that have been
+// imported by Nickel since the metadata file was read into the metadata map.
+// They are recorded as changed, so their metadata is written to the Nickel DB.
+func (k *Kobo) reconcileUnmatchedMD() error {
+	if len(k.unmatchedMD) == 0 {
+		return nil
+	}
+	nickelDB, err := k.openNickelDB(true)
+	if err != nil {
+		return fmt.Errorf("reconcileUnmatchedMD: %w", err)
+	}
+	defer nickelDB.Close()
+	for lpath, raw := range k.unmatchedMD {
+		cid := util.LpathToContentID(lpath, string(k.ContentIDprefix))
+		var count int
+		if err = nickelDB.QueryRow(`SELECT COUNT(1) FROM content WHERE ContentID=? AND ContentType=6;`, cid).Scan(&count); err != nil {
+			return fmt.Errorf("reconcileUnmatchedMD: error looking up %s: %w", cid, err)
+		}
+		if count == 0 {
+			continue
+		}
+		if _, exists := k.Metadata.Get(cid); !exists {
+			rec, err := decodeMDrecord(raw)
+			if err != nil {
+				return fmt.Errorf("reconcileUnmatchedMD: %s: %w", lpath, err)
+			}
+			k.Metadata.Put(cid, rec.CalibreBookMeta)
+			k.Metadata.SetSHA256(cid, rec.SHA256)
+			log.Printf("reconcileUnmatchedMD: %s is now in the Nickel DB", lpath)
+		}
+		delete(k.unmatchedMD, lpath)
+	}
+	return nil
+}
+
 func (k *Kobo) loadDeviceInfo() error {
 	emptyOrNotExist, err := util.ReadJSON(filepath.Join(k.BKRootDir, calibreDIfile), &k.DriveInfo.DevInfo)
 	if emptyOrNotExist {
@@ -559,12 +737,58 @@ func (k *Kobo) loadDeviceInfo() error {
 
 // SaveDeviceInfo save device info to file
 func (k *Kobo) SaveDeviceInfo() error {
+	if k.DryRun() {
+		k.DryRunf("would write %s", calibreDIfile)
+		return nil
+	}
+	if err := k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("SaveDeviceInfo: %w", err)
+	}
 	if err := util.WriteJSON(filepath.Join(k.BKRootDir, calibreDIfile), k.DriveInfo.DevInfo); err != nil {
 		return fmt.Errorf("SaveDeviceInfo: error saving device info JSON: %w", err)
 	}
 	return nil
 }
 
+// generatedCoverTypes gets the cover images generated by Kobo UNCaGED, rather
+// than by Nickel, at the configured generate level
+func (k *Kobo) generatedCoverTypes() []kobo.CoverType {
+	switch k.KuConfig.Thumbnail.GenerateLevel {
+	case GenerateAll:
+		return []kobo.CoverType{kobo.CoverTypeFull, kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid}
+	case GeneratePartial:
+		return []kobo.CoverType{kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid}
+	}
+	return nil
+}
+
+// removeStaleCovers removes the cover images Nickel generated for books whose
+// content was replaced, so Nickel generates them again from the new copy
+func (k *Kobo) removeStaleCovers() {
+	generated := make(map[kobo.CoverType]bool)
+	for _, cover := range k.generatedCoverTypes() {
+		generated[cover] = true
+	}
+	for cid := range k.replacedBooks {
+		imgID := kobo.ContentIDToImageID(cid)
+		for _, cover := range []kobo.CoverType{kobo.CoverTypeFull, kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid} {
+			if generated[cover] {
+				continue
+			}
+			fn := filepath.Join(k.BKRootDir, cover.GeneratePath(k.UseSDCard, imgID))
+			if k.DryRun() {
+				if _, err := os.Stat(fn); err == nil {
+					k.DryRunf("would remove stale %s cover of %s", cover, cid)
+				}
+				continue
+			}
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				log.Printf("removeStaleCovers: %v", err)
+			}
+		}
+	}
+}
+
 // SaveCoverImage generates cover image and thumbnails, and save to appropriate locations
 func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string, done chan<- struct{}) {
 	defer func() {
@@ -580,14 +804,7 @@ func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string,
 	imgID := kobo.ContentIDToImageID(contentID)
 	jpegOpts := jpeg.Options{Quality: k.KuConfig.Thumbnail.JpegQuality}
 
-	var coverEndings []kobo.CoverType
-	switch k.KuConfig.Thumbnail.GenerateLevel {
-	case GenerateAll:
-		coverEndings = []kobo.CoverType{kobo.CoverTypeFull, kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid}
-	case GeneratePartial:
-		coverEndings = []kobo.CoverType{kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid}
-	}
-	for _, cover := range coverEndings {
+	for _, cover := range k.generatedCoverTypes() {
 		nsz := k.Device.CoverSized(cover, sz)
 		nfn := filepath.Join(k.BKRootDir, cover.GeneratePath(k.UseSDCard, imgID))
 		//fmt.Printf("Cover file path is: %s\n", nfn)
@@ -626,93 +843,8 @@ func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string,
 	}
 }
 
-// WriteUpdatedMetadataSQL writes SQL to write updated metadata to
-// the Kobo database. The SQLite CLI client will be used to perform the import.
-func (k *Kobo) WriteUpdatedMetadataSQL() (bool, error) {
-	var err error
-	updateMetadata := false
-	for _, m := range k.MetadataMap {
-		if m.NewBook || m.UpdatedBook {
-			updateMetadata = true
-		}
-	}
-	if !updateMetadata {
-		return false, nil
-	}
-	updateSQL, err := newSQLWriter(filepath.Join(k.BKRootDir, kuUpdatedSQL))
-	if err != nil {
-		return false, fmt.Errorf("WriteUpdatedMetadataSQL: failed to create SQL writer: %w", err)
-	}
-	defer updateSQL.close()
-	dialect := goqu.Dialect("sqlite3")
-	var desc, series, seriesNum, subtitle *string
-	var seriesNumFloat *float64
-	for cid, m := range k.MetadataMap {
-		desc, series, seriesNum, seriesNumFloat, subtitle = nil, nil, nil, nil, nil
-		if m.Meta.Comments != nil && *m.Meta.Comments != "" {
-			desc = m.Meta.Comments
-		}
-		if m.Meta.Series != nil && *m.Meta.Series != "" {
-			// TODO: Fuzzy series matching to deal with 'The' prefixes and 'Series' postfixes?
-			series = m.Meta.Series
-		}
-		if m.Meta.SeriesIndex != nil && *m.Meta.SeriesIndex != 0.0 {
-			sn := strconv.FormatFloat(*m.Meta.SeriesIndex, 'f', -1, 64)
-			seriesNum = &sn
-			seriesNumFloat = m.Meta.SeriesIndex
-		}
-		if field, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists && field.SubtitleColumn != "" {
-			col := field.SubtitleColumn
-			md := m.Meta
-			st := ""
-			if col == "languages" {
-				st = md.LangString()
-			} else if col == "tags" {
-				st = md.TagString()
-			} else if col == "publisher" {
-				st = md.PubString()
-			} else if col == "rating" {
-				st = md.RatingString()
-			} else if strings.HasPrefix(col, "#") {
-				if cc, exists := md.UserMetadata[col]; exists {
-					st = cc.ContextualString()
-				}
-			}
-			if st != "" {
-				subtitle = &st
-			}
-		}
-		ds := dialect.Update("content").Set(goqu.Record{
-			"Description": desc, "Series": series, "SeriesNumber": seriesNum, "SeriesNumberFloat": seriesNumFloat, "Subtitle": subtitle,
-		}).Where(goqu.Ex{"ContentID": cid})
-		sqlStr, _, err := ds.ToSQL()
-		if err != nil {
-			return false, fmt.Errorf("WriteUpdatedMetadataSQL: failed ")
-		}
-		updateSQL.writeQuery(sqlStr)
-	}
-	// Note, the SeriesID stuff was implemented in FW 4.20.14601
-	if kobo.VersionCompare(string(k.fw), "4.20.14601") >= 0 {
-		// Set the SeriesID column correctly
-		// Note, UPDATE FROM is brand spanking new in SQLite 3.33.0 (2020-08-14). We're going to need the latest
-		// client for this one
-		updateSQL.writeQuery(
-			`UPDATE content SET SeriesID = c.SeriesID 
-FROM (
-	SELECT DISTINCT Series, SeriesID FROM content 
-	WHERE ContentType = 6 AND ContentID NOT LIKE 'file://%' AND (Series IS NOT NULL AND Series <> '') AND (SeriesID IS NOT NULL AND SeriesID <> '')
-) AS c 
-WHERE content.Series = c.Series;`)
-		updateSQL.writeQuery(`UPDATE content SET SeriesID=Series WHERE ContentType = 6 AND (Series IS NOT NULL OR Series <> '') AND (SeriesID IS NULL OR SeriesID <> '');`)
-	}
-	return true, nil
-}
-
 // Close the kobo object when we're finished with it
 func (k *Kobo) Close() {
-	if k.replSQLWriter != nil {
-		k.replSQLWriter.close()
-	}
 	if k.useNDB && !k.BrowserOpen {
 		k.ndbObj.Call(ndbInterface+".mwcToast", 0, 3000, k.FinishedMsg)
 	} else {
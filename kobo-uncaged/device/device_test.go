@@ -0,0 +1,82 @@
+package device
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStableBookUUID(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "book.pdf")
+	if err := os.WriteFile(fn, []byte("first version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cid := "file:///mnt/onboard/book.pdf"
+	first := stableBookUUID(cid, fn)
+	if again := stableBookUUID(cid, fn); again != first {
+		t.Errorf("UUID changed between calls: %s, %s", first, again)
+	}
+	if other := stableBookUUID("file:///mnt/onboard/other.pdf", fn); other == first {
+		t.Errorf("different ContentID gave the same UUID")
+	}
+	if err := os.WriteFile(fn, []byte("second version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if replaced := stableBookUUID(cid, fn); replaced == first {
+		t.Errorf("replaced book kept the same UUID")
+	}
+}
+
+func TestLoadUncachedMeta(t *testing.T) {
+	k := &Kobo{
+		BKRootDir:       t.TempDir(),
+		ContentIDprefix: onboardPrefix,
+		KuConfig:        &KuOptions{},
+		Metadata:        NewMetadataStore(0),
+	}
+	dbMeta := make(map[string]dbBookMeta)
+	for i := 0; i < 20; i++ {
+		cid := fmt.Sprintf("file:///mnt/onboard/book%d.pdf", i)
+		title, authors := fmt.Sprintf("Book %d", i), "A. Author, B. Author"
+		k.Metadata.set(cid, BookMeta{})
+		dbMeta[cid] = dbBookMeta{title: &title, attr: &authors}
+	}
+	k.loadUncachedMeta(dbMeta)
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		if m.Meta == nil || m.Meta.Title != *dbMeta[cid].title || len(m.Meta.Authors) != 2 || m.Meta.UUID == "" {
+			t.Errorf("%s: metadata not loaded: %+v", cid, m.Meta)
+		}
+		return true
+	})
+}
+
+func TestBuildBookMeta(t *testing.T) {
+	k := &Kobo{
+		BKRootDir:       t.TempDir(),
+		ContentIDprefix: onboardPrefix,
+		KuConfig:        &KuOptions{},
+	}
+	f, err := os.Create(filepath.Join(k.BKRootDir, "comic.cbz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("ComicInfo.xml")
+	w.Write([]byte(testComicInfo))
+	zw.Close()
+	f.Close()
+	// Nickel only has the file name as the title of most comics
+	title, authors := "comic", "Unknown"
+	md := k.buildBookMeta("file:///mnt/onboard/comic.cbz", dbBookMeta{title: &title, attr: &authors})
+	if md.Title != "The Long Way" || !reflect.DeepEqual(md.Authors, []string{"Brian K. Vaughan"}) {
+		t.Errorf("title/authors = %q/%v, want those of the file", md.Title, md.Authors)
+	}
+	// The DB is still used when the file has none
+	md = k.buildBookMeta("file:///mnt/onboard/missing.pdf", dbBookMeta{title: &title, attr: &authors})
+	if md.Title != title || !reflect.DeepEqual(md.Authors, []string{authors}) {
+		t.Errorf("title/authors = %q/%v, want those of the DB", md.Title, md.Authors)
+	}
+}
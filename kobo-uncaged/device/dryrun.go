@@ -0,0 +1,88 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// dryRunLog records the changes a dry run session would have made
+type dryRunLog struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+// DryRun reports whether this is a dry run session, where nothing on the
+// device is changed
+func (k *Kobo) DryRun() bool {
+	return k.dryRun != nil
+}
+
+// DryRunf records a change that was skipped because this is a dry run
+func (k *Kobo) DryRunf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("[dry run] %s", msg)
+	k.dryRun.mu.Lock()
+	defer k.dryRun.mu.Unlock()
+	k.dryRun.changes = append(k.dryRun.changes, msg)
+}
+
+// dryRunChanges gets the changes recorded this session
+func (k *Kobo) dryRunChanges() []string {
+	changes := make([]string, 0)
+	if k.dryRun == nil {
+		return changes
+	}
+	k.dryRun.mu.Lock()
+	defer k.dryRun.mu.Unlock()
+	return append(changes, k.dryRun.changes...)
+}
+
+// nickelTx is a transaction on the Nickel DB. During a dry run the DB is
+// opened read-only, and statements that would change it are logged instead
+// of executed.
+type nickelTx struct {
+	*sql.Tx
+	k *Kobo
+}
+
+// dryRunResult is the result of a statement skipped by a dry run. Every
+// statement is assumed to have found its row.
+type dryRunResult struct{}
+
+func (dryRunResult) LastInsertId() (int64, error) { return 0, nil }
+func (dryRunResult) RowsAffected() (int64, error) { return 1, nil }
+
+// beginTx begins a transaction on db
+func (k *Kobo) beginTx(db *sql.DB) (*nickelTx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &nickelTx{Tx: tx, k: k}, nil
+}
+
+// Exec executes query, unless this is a dry run, in which case the query is
+// recorded instead
+func (tx *nickelTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if tx.k.DryRun() {
+		if len(args) > 0 {
+			tx.k.DryRunf("would run: %s %v", query, args)
+		} else {
+			tx.k.DryRunf("would run: %s", query)
+		}
+		return dryRunResult{}, nil
+	}
+	return tx.Tx.Exec(query, args...)
+}
+
+// commitTx commits tx, unless this is a dry run, in which case it is rolled
+// back and the change described by what is recorded instead
+func (k *Kobo) commitTx(tx *nickelTx, what string) error {
+	if k.DryRun() {
+		k.DryRunf("would commit Nickel database changes: %s", what)
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
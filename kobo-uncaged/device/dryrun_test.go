@@ -0,0 +1,74 @@
+package device
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	k := &Kobo{
+		BKRootDir:       dir,
+		ContentIDprefix: onboardPrefix,
+		Metadata:        NewMetadataStore(0),
+		unmatchedMD:     make(map[string]json.RawMessage),
+		dryRun:          &dryRunLog{},
+	}
+	cid := string(onboardPrefix) + "a.epub"
+	k.Metadata.Put(cid, &uc.CalibreBookMeta{Lpath: "a.epub", Title: "A"})
+	if err := k.RecordMetadata(cid); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.CompactMDfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.SaveDeviceInfo(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{calibreMDjournal, calibreMDfile, calibreDIfile} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Errorf("%s written during a dry run", fn)
+		}
+	}
+	want := []string{"would write metadata.calibre with 1 record(s)", "would write driveinfo.calibre"}
+	changes := k.dryRunChanges()
+	if len(changes) != len(want) {
+		t.Fatalf("dryRunChanges() = %q, want %q", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %q, want %q", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestDryRunNickelDB(t *testing.T) {
+	dir, db := newTestNickelDB(t, `CREATE TABLE DbVersion (version INTEGER); INSERT INTO DbVersion VALUES (170);
+		CREATE TABLE content (ContentID TEXT, ContentType INT, ___FileSize INT);`)
+	cid := string(onboardPrefix) + "a.epub"
+	if _, err := db.Exec(`INSERT INTO content VALUES (?, 6, 100);`, cid); err != nil {
+		t.Fatal(err)
+	}
+	k := &Kobo{
+		DBRootDir:     dir,
+		Metadata:      NewMetadataStore(0),
+		replacedBooks: map[string]int{cid: 120},
+		dryRun:        &dryRunLog{},
+	}
+	if err := k.updateReplacedBooks(); err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if err := db.QueryRow(`SELECT ___FileSize FROM content;`).Scan(&size); err != nil || size != 100 {
+		t.Errorf("filesize = %d, %v, want 100", size, err)
+	}
+	changes := k.dryRunChanges()
+	if len(changes) != 2 || !strings.HasPrefix(changes[0], "would run: UPDATE") {
+		t.Errorf("dryRunChanges() = %q, want the UPDATE and the commit", changes)
+	}
+}
@@ -0,0 +1,80 @@
+package device
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// readBookMeta reads the metadata embedded in a book file, using the reader
+// for its format. Only metadata not available from the DB is obtained.
+func (k *Kobo) readBookMeta(contentID string, md *uc.CalibreBookMeta) error {
+	bkPath := util.ContentIDtoBkPath(k.BKRootDir, contentID, string(k.ContentIDprefix))
+	var err error
+	switch ext := strings.ToLower(bkPath); {
+	case strings.HasSuffix(ext, ".epub"):
+		return k.readEpubMeta(contentID, md)
+	case strings.HasSuffix(ext, ".pdf"):
+		err = readPDFMeta(bkPath, md)
+	case strings.HasSuffix(ext, ".cbz"):
+		err = readCBZMeta(bkPath, md)
+	case strings.HasSuffix(ext, ".cbr"):
+		err = readCBRMeta(bkPath, md)
+	case strings.HasSuffix(ext, ".mobi"):
+		err = readMOBIMeta(bkPath, md)
+	}
+	if err != nil {
+		return fmt.Errorf("readBookMeta: %w", err)
+	}
+	return nil
+}
+
+// setIdentifier adds a book identifier. As for epubs, a Calibre or generic
+// UUID sets the book UUID instead, preferring the Calibre one.
+func setIdentifier(md *uc.CalibreBookMeta, scheme, value string) {
+	scheme, value = strings.ToLower(strings.TrimSpace(scheme)), strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	switch scheme {
+	case "calibre":
+		md.UUID = value
+	case "uuid":
+		if md.UUID == "" {
+			md.UUID = value
+		}
+	case "":
+	default:
+		if md.Identifiers == nil {
+			md.Identifiers = make(map[string]string)
+		}
+		md.Identifiers[scheme] = value
+	}
+}
+
+// splitNames splits a list of names or tags on any of the separators,
+// dropping empty entries
+func splitNames(s string, seps string) []string {
+	var names []string
+	for _, n := range strings.FieldsFunc(s, func(r rune) bool { return strings.ContainsRune(seps, r) }) {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// parseLooseTime parses the date formats commonly found in book files
+func parseLooseTime(s string) *uc.CalibreTime {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			ct := uc.ConvertTime(t.UTC())
+			return &ct
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package device
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+const testComicInfo = `<?xml version="1.0"?>
+<ComicInfo>
+  <Title>The Long Way</Title>
+  <Series>Saga</Series>
+  <Number>3</Number>
+  <Writer>Brian K. Vaughan</Writer>
+  <Publisher>Image</Publisher>
+  <Year>2013</Year>
+  <Month>6</Month>
+  <LanguageISO>en</LanguageISO>
+</ComicInfo>`
+
+func checkComicMeta(t *testing.T, md uc.CalibreBookMeta) {
+	t.Helper()
+	if md.Title != "The Long Way" || md.Series == nil || *md.Series != "Saga" || md.SeriesIndex == nil || *md.SeriesIndex != 3 {
+		t.Errorf("title/series = %q/%v, want 'The Long Way'/Saga #3", md.Title, md.Series)
+	}
+	if !reflect.DeepEqual(md.Authors, []string{"Brian K. Vaughan"}) || !reflect.DeepEqual(md.Languages, []string{"en"}) {
+		t.Errorf("authors/languages = %v/%v", md.Authors, md.Languages)
+	}
+	if md.Pubdate == nil || *md.Pubdate != "2013-06-01T00:00:00Z" {
+		t.Errorf("pubdate = %v, want 2013-06-01", md.Pubdate)
+	}
+}
+
+func TestReadCBZMeta(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "comic.cbz")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("ComicInfo.xml")
+	w.Write([]byte(testComicInfo))
+	zw.Close()
+	f.Close()
+	var md uc.CalibreBookMeta
+	if err = readCBZMeta(fn, &md); err != nil {
+		t.Fatal(err)
+	}
+	checkComicMeta(t, md)
+}
+
+func TestReadCBRMeta(t *testing.T) {
+	le := binary.LittleEndian
+	// RAR 4: marker, archive header, a page, ComicInfo.xml, and the end block
+	rar4Block := func(h []byte) []byte {
+		le.PutUint16(h, uint16(crc32.ChecksumIEEE(h[2:])))
+		return h
+	}
+	rar4File := func(name string, data []byte) []byte {
+		h := make([]byte, 32, 32+len(name))
+		h[2] = 0x74
+		le.PutUint16(h[3:], 0x8000)
+		le.PutUint16(h[5:], uint16(32+len(name)))
+		le.PutUint32(h[7:], uint32(len(data)))
+		le.PutUint32(h[11:], uint32(len(data)))
+		le.PutUint32(h[16:], crc32.ChecksumIEEE(data))
+		h[24], h[25] = 29, 0x30 // Stored
+		le.PutUint16(h[26:], uint16(len(name)))
+		return append(rar4Block(append(h, name...)), data...)
+	}
+	var rar4 bytes.Buffer
+	rar4.WriteString("Rar!\x1a\x07\x00")
+	rar4.Write(rar4Block([]byte{0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0}))
+	rar4.Write(rar4File("page1.jpg", []byte("not really a jpeg")))
+	rar4.Write(rar4File(`comic\ComicInfo.xml`, []byte(testComicInfo)))
+	rar4.Write(rar4Block([]byte{0, 0, 0x7b, 0, 0, 7, 0}))
+
+	// RAR 5: main header, a page, ComicInfo.xml, and the end header
+	rar5Block := func(fields ...uint64) []byte {
+		var h []byte
+		for _, f := range fields {
+			h = binary.AppendUvarint(h, f)
+		}
+		return h
+	}
+	rar5Header := func(h []byte) []byte {
+		h = append(binary.AppendUvarint(nil, uint64(len(h))), h...)
+		return append(le.AppendUint32(nil, crc32.ChecksumIEEE(h)), h...)
+	}
+	rar5File := func(name string, data []byte) []byte {
+		// type, flags (data area), data size, file flags (CRC), unpacked size, attributes, CRC,
+		// compression (stored), host OS, name length
+		h := rar5Block(2, 0x02, uint64(len(data)), 0x04, uint64(len(data)), 0)
+		h = le.AppendUint32(h, crc32.ChecksumIEEE(data))
+		h = append(append(h, rar5Block(0, 0, uint64(len(name)))...), name...)
+		return append(rar5Header(h), data...)
+	}
+	var rar5 bytes.Buffer
+	rar5.WriteString("Rar!\x1a\x07\x01\x00")
+	rar5.Write(rar5Header(rar5Block(1, 0, 0)))
+	rar5.Write(rar5File("page1.jpg", []byte("not really a jpeg")))
+	rar5.Write(rar5File("ComicInfo.xml", []byte(testComicInfo)))
+	rar5.Write(rar5Header(rar5Block(5, 0, 0)))
+
+	for name, archive := range map[string][]byte{"rar4": rar4.Bytes(), "rar5": rar5.Bytes()} {
+		fn := filepath.Join(t.TempDir(), "comic.cbr")
+		if err := os.WriteFile(fn, archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var md uc.CalibreBookMeta
+		if err := readCBRMeta(fn, &md); err != nil {
+			t.Errorf("%s: readCBRMeta() error = %v", name, err)
+			continue
+		}
+		checkComicMeta(t, md)
+	}
+}
+
+func TestReadPDFMeta(t *testing.T) {
+	pdf := `%PDF-1.4
+1 0 obj
+<< /Type /Catalog /Pages 2 0 R /Metadata 4 0 R >>
+endobj
+13 0 obj
+<< /Title (Wrong object) >>
+endobj
+3 0 obj
+<< /Title (Old \(draft\) title) /Author <FEFF004A0061006E006500200044006F0065> /Keywords (maths; physics)
+   /CreationDate (D:20190305120000+01'00') /Producer (Test) >>
+endobj
+4 0 obj
+<< /Type /Metadata /Subtype /XML /Length 0 >>
+stream
+<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"
+  xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:xmpidq="http://ns.adobe.com/xmp/Identifier/qual/1.0/"
+  xmlns:calibre="http://calibre-ebook.com/xmp-namespace" xmlns:calibreSI="http://calibre-ebook.com/xmp-namespace-series-index">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">A Brief History</rdf:li></rdf:Alt></dc:title>
+<dc:language><rdf:Bag><rdf:li>en</rdf:li></rdf:Bag></dc:language>
+<dc:identifier><rdf:Bag><rdf:li>urn:doi:10.1000/182</rdf:li></rdf:Bag></dc:identifier>
+<xmp:Identifier><rdf:Bag>
+  <rdf:li rdf:parseType="Resource"><xmpidq:Scheme>isbn</xmpidq:Scheme><rdf:value>9780553380163</rdf:value></rdf:li>
+  <rdf:li rdf:parseType="Resource"><xmpidq:Scheme>calibre</xmpidq:Scheme><rdf:value>0f8d1c5e-uuid</rdf:value></rdf:li>
+</rdf:Bag></xmp:Identifier>
+<calibre:series rdf:parseType="Resource"><rdf:value>Cosmos</rdf:value><calibreSI:series_index>2.00</calibreSI:series_index></calibre:series>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+endstream
+endobj
+trailer
+<< /Root 1 0 R /Info 3 0 R /Size 5 >>
+%%EOF
+`
+	fn := filepath.Join(t.TempDir(), "book.pdf")
+	if err := os.WriteFile(fn, []byte(pdf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var md uc.CalibreBookMeta
+	if err := readPDFMeta(fn, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Title != "A Brief History" {
+		t.Errorf("title = %q, want the XMP title", md.Title)
+	}
+	if !reflect.DeepEqual(md.Authors, []string{"Jane Doe"}) || !reflect.DeepEqual(md.Tags, []string{"maths", "physics"}) {
+		t.Errorf("authors/tags = %v/%v", md.Authors, md.Tags)
+	}
+	if md.Pubdate == nil || *md.Pubdate != "2019-03-05T11:00:00Z" {
+		t.Errorf("pubdate = %v, want 2019-03-05T11:00:00Z", md.Pubdate)
+	}
+	if md.Series == nil || *md.Series != "Cosmos" || md.SeriesIndex == nil || *md.SeriesIndex != 2 {
+		t.Errorf("series = %v, want Cosmos #2", md.Series)
+	}
+	if md.UUID != "0f8d1c5e-uuid" || md.Identifiers["isbn"] != "9780553380163" || md.Identifiers["doi"] != "10.1000/182" {
+		t.Errorf("uuid/identifiers = %q/%v", md.UUID, md.Identifiers)
+	}
+	if !reflect.DeepEqual(md.Languages, []string{"en"}) {
+		t.Errorf("languages = %v, want [en]", md.Languages)
+	}
+}
+
+func TestReadPDFXref(t *testing.T) {
+	var pdf bytes.Buffer
+	offsets := make(map[int]int)
+	obj := func(num int, body string) {
+		offsets[num] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", num, body)
+	}
+	xref := func(first, count int, trailer string) int {
+		pos := pdf.Len()
+		fmt.Fprintf(&pdf, "xref\n%d %d\n", first, count)
+		for n := first; n < first+count; n++ {
+			if n == 0 {
+				pdf.WriteString("0000000000 65535 f\r\n")
+			} else {
+				fmt.Fprintf(&pdf, "%010d 00000 n\r\n", offsets[n])
+			}
+		}
+		fmt.Fprintf(&pdf, "trailer\n%s\nstartxref\n%d\n%%%%EOF\n", trailer, pos)
+		return pos
+	}
+	xmp := func(title string) string {
+		return `<< /Type /Metadata /Subtype /XML >>
+stream
+<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">` + title + `</rdf:li></rdf:Alt></dc:title>
+</rdf:Description></rdf:RDF></x:xmpmeta>
+endstream`
+	}
+	pdf.WriteString("%PDF-1.4\n")
+	obj(1, "<< /Type /Catalog /Pages 2 0 R /Metadata 4 0 R >>")
+	obj(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	obj(3, "<< /Title (Old title) /Author (Old Author) >>")
+	obj(4, xmp("Document title"))
+	// The XMP packet of an image, which is last in the file, but not that of the document
+	obj(5, xmp("Image title"))
+	prev := xref(0, 6, "<< /Root 1 0 R /Info 3 0 R /Size 6 >>")
+	// An incremental update replaces the Info dictionary
+	obj(3, "<< /Author (Jane Doe) >>")
+	xref(3, 1, fmt.Sprintf("<< /Root 1 0 R /Info 3 0 R /Size 6 /Prev %d >>", prev))
+
+	r := bytes.NewReader(pdf.Bytes())
+	infoOff, xmpOff, err := pdfXrefOffsets(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infoOff != int64(offsets[3]) {
+		t.Errorf("info dictionary at %d, want %d", infoOff, offsets[3])
+	}
+	if xmpOff < int64(offsets[4]) || xmpOff > int64(offsets[5]) {
+		t.Errorf("xmp packet at %d, want in object 4 at %d", xmpOff, offsets[4])
+	}
+	fn := filepath.Join(t.TempDir(), "book.pdf")
+	if err = os.WriteFile(fn, pdf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var md uc.CalibreBookMeta
+	if err = readPDFMeta(fn, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Title != "Document title" || !reflect.DeepEqual(md.Authors, []string{"Jane Doe"}) {
+		t.Errorf("title/authors = %q/%v, want 'Document title'/[Jane Doe]", md.Title, md.Authors)
+	}
+	// A table that doesn't match the file is not trusted
+	r = bytes.NewReader(bytes.Replace(pdf.Bytes(), []byte("3 0 obj"), []byte("3 0 xyz"), -1))
+	if _, _, err = pdfXrefOffsets(r, r.Size()); err == nil {
+		t.Errorf("pdfXrefOffsets() accepted a wrong offset")
+	}
+}
+
+func TestParseMOBI(t *testing.T) {
+	be := binary.BigEndian
+	var exth bytes.Buffer
+	record := func(typ uint32, val string) {
+		binary.Write(&exth, be, [2]uint32{typ, uint32(8 + len(val))})
+		exth.WriteString(val)
+	}
+	record(exthAuthor, "Ursula K. Le Guin")
+	record(exthPublisher, "Ace")
+	record(exthISBN, "9780441478125")
+	record(exthSource, "calibre:2a4f-uuid")
+	record(exthPubdate, "1969-03-01T00:00:00+00:00")
+	record(exthLanguage, "en")
+	record(exthTitle, "The Left Hand of Darkness")
+
+	const rec0, mobiLen = 88, 232
+	name := "Left Hand Full Name"
+	buf := make([]byte, rec0+16+mobiLen)
+	copy(buf[60:], "BOOKMOBI")
+	be.PutUint16(buf[76:], 1)
+	be.PutUint32(buf[78:], rec0)
+	hdr := buf[rec0:]
+	copy(hdr[16:], "MOBI")
+	be.PutUint32(hdr[20:], mobiLen)
+	be.PutUint32(hdr[28:], mobiUTF8)
+	be.PutUint32(hdr[84:], uint32(16+mobiLen+12+exth.Len()))
+	be.PutUint32(hdr[88:], uint32(len(name)))
+	be.PutUint32(hdr[128:], 0x40)
+	buf = append(buf, "EXTH"...)
+	buf = be.AppendUint32(buf, uint32(12+exth.Len()))
+	buf = be.AppendUint32(buf, 7)
+	buf = append(buf, exth.Bytes()...)
+	buf = append(buf, name...)
+
+	var md uc.CalibreBookMeta
+	if err := parseMOBI(bytes.NewReader(buf), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Title != "The Left Hand of Darkness" || !reflect.DeepEqual(md.Authors, []string{"Ursula K. Le Guin"}) {
+		t.Errorf("title/authors = %q/%v", md.Title, md.Authors)
+	}
+	if md.Publisher == nil || *md.Publisher != "Ace" || md.UUID != "2a4f-uuid" || md.Identifiers["isbn"] != "9780441478125" {
+		t.Errorf("publisher/uuid/identifiers = %v/%q/%v", md.Publisher, md.UUID, md.Identifiers)
+	}
+	if md.Pubdate == nil || *md.Pubdate != "1969-03-01T00:00:00Z" || !reflect.DeepEqual(md.Languages, []string{"en"}) {
+		t.Errorf("pubdate/languages = %v/%v", md.Pubdate, md.Languages)
+	}
+}
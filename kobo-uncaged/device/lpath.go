@@ -0,0 +1,125 @@
+package device
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+)
+
+// FAT32 and ext4 limit file names to 255 bytes (FAT32 in UTF-16 units). Some
+// room is left for collision suffixes.
+const maxLpathPart = 240
+const maxLpathLen = 1024
+
+// maxLpathExt is the longest suffix treated as an extension. Anything longer is
+// most likely part of the name, eg: "Vol. 1 - ...".
+const maxLpathExt = 32
+
+// maxCollisions is the number of " (n)" suffixes tried before falling back to
+// a hash of the lpath
+const maxCollisions = 99
+
+// ResolveLpath decides where a book Calibre is sending is stored on the device.
+// Books already on the device, including those Nickel has yet to import, keep
+// their lpath. New books have overlong names shortened, and get a " (n)" suffix
+// if another book or file already has their lpath.
+func (k *Kobo) ResolveLpath(lpath string) string {
+	if k.IsStoreBook(lpath) {
+		return lpath
+	}
+	if _, exists := k.Metadata.Get(util.LpathToContentID(lpath, string(k.ContentIDprefix))); exists {
+		return lpath
+	}
+	if _, exists := k.unmatchedMD[lpath]; exists {
+		return lpath
+	}
+	newLpath := limitLpath(lpath)
+	taken := k.takenLpaths()
+	isTaken := func(p string) bool { return taken[strings.ToLower(p)] || k.lpathFileExists(p) }
+	base, ext := splitLpathExt(newLpath)
+	for n := 2; n <= maxCollisions && isTaken(newLpath); n++ {
+		newLpath = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	// Rehash until a free lpath is found, so Calibre never replaces another book
+	for h := lpath; isTaken(newLpath); {
+		sum := sha256.Sum256([]byte(h))
+		h = hex.EncodeToString(sum[:])
+		newLpath = fmt.Sprintf("%s (%s)%s", base, h[:8], ext)
+	}
+	if newLpath != lpath {
+		k.DebugLogPrintf("ResolveLpath: %s -> %s", lpath, newLpath)
+	}
+	return newLpath
+}
+
+// takenLpaths gets the lpaths of the books on the device, in lower case, as
+// the FAT32 filesystem used for book storage ignores case
+func (k *Kobo) takenLpaths() map[string]bool {
+	taken := make(map[string]bool, k.Metadata.Len()+len(k.unmatchedMD))
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		taken[strings.ToLower(util.ContentIDtoLpath(cid, string(k.ContentIDprefix)))] = true
+		return true
+	})
+	for lpath := range k.unmatchedMD {
+		taken[strings.ToLower(lpath)] = true
+	}
+	return taken
+}
+
+// lpathFileExists tests whether a file not known to Kobo UNCaGED (eg: copied
+// over USB) is at lpath
+func (k *Kobo) lpathFileExists(lpath string) bool {
+	_, err := os.Stat(filepath.Join(k.BKRootDir, lpath))
+	return err == nil
+}
+
+// limitLpath shortens each part of lpath to maxLpathPart bytes, keeping the
+// extension, then drops leading directories until lpath fits in maxLpathLen
+func limitLpath(lpath string) string {
+	base, ext := splitLpathExt(lpath)
+	parts := strings.Split(base, "/")
+	for i := range parts {
+		limit := maxLpathPart
+		if i == len(parts)-1 {
+			limit -= len(ext)
+		}
+		parts[i] = truncateUTF8(parts[i], limit)
+	}
+	for len(parts) > 1 && len(strings.Join(parts, "/"))+len(ext) > maxLpathLen {
+		parts = parts[1:]
+	}
+	return strings.Join(parts, "/") + ext
+}
+
+// splitLpathExt splits lpath into the path without its extension, and the
+// extension. ".kepub.epub" is treated as a single extension.
+func splitLpathExt(lpath string) (string, string) {
+	ext := path.Ext(lpath)
+	if strings.HasSuffix(strings.ToLower(lpath), ".kepub.epub") {
+		ext = lpath[len(lpath)-len(".kepub.epub"):]
+	} else if len(ext) > maxLpathExt {
+		ext = ""
+	}
+	return strings.TrimSuffix(lpath, ext), ext
+}
+
+// truncateUTF8 shortens s to at most n bytes, without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return strings.TrimSpace(s[:n])
+}
@@ -0,0 +1,65 @@
+package device
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveLpath(t *testing.T) {
+	dir := t.TempDir()
+	k := &Kobo{
+		BKRootDir:       dir,
+		ContentIDprefix: onboardPrefix,
+		Metadata:        NewMetadataStore(1),
+		KuConfig:        &KuOptions{},
+		unmatchedMD:     map[string]json.RawMessage{"Pending/Book.epub": nil},
+	}
+	k.Metadata.set("file:///mnt/onboard/Author/Title.epub", BookMeta{})
+
+	// Books already on the device keep their lpath
+	if got := k.ResolveLpath("Author/Title.epub"); got != "Author/Title.epub" {
+		t.Errorf("existing book moved to %s", got)
+	}
+	// As do books sent earlier that Nickel has yet to import
+	os.MkdirAll(filepath.Join(dir, "Pending"), 0755)
+	os.WriteFile(filepath.Join(dir, "Pending", "Book.epub"), nil, 0644)
+	if got := k.ResolveLpath("Pending/Book.epub"); got != "Pending/Book.epub" {
+		t.Errorf("pending book moved to %s", got)
+	}
+	// A book whose lpath differs only by case from another gets a suffix
+	if got := k.ResolveLpath("author/title.epub"); got != "author/title (2).epub" {
+		t.Errorf("ResolveLpath() = %s, want author/title (2).epub", got)
+	}
+	// As does a book whose lpath is taken by a file copied over USB
+	os.MkdirAll(filepath.Join(dir, "Other"), 0755)
+	os.WriteFile(filepath.Join(dir, "Other", "Book.kepub.epub"), nil, 0644)
+	if got := k.ResolveLpath("Other/Book.kepub.epub"); got != "Other/Book (2).kepub.epub" {
+		t.Errorf("ResolveLpath() = %s, want Other/Book (2).kepub.epub", got)
+	}
+	// Once the numbered suffixes run out, a hash of the lpath is used
+	os.WriteFile(filepath.Join(dir, "Other", "Book.epub"), nil, 0644)
+	for n := 2; n <= maxCollisions; n++ {
+		os.WriteFile(filepath.Join(dir, "Other", fmt.Sprintf("Book (%d).epub", n)), nil, 0644)
+	}
+	sum := sha256.Sum256([]byte("Other/Book.epub"))
+	want := "Other/Book (" + hex.EncodeToString(sum[:])[:8] + ").epub"
+	if got := k.ResolveLpath("Other/Book.epub"); got != want {
+		t.Errorf("ResolveLpath() = %s, want %s", got, want)
+	}
+	// Overlong names are shortened, keeping the extension
+	got := k.ResolveLpath("Author/" + strings.Repeat("é", 200) + ".epub")
+	if name := filepath.Base(got); len(name) > maxLpathPart || !strings.HasSuffix(name, "é.epub") {
+		t.Errorf("long name shortened to %s (%d bytes)", name, len(name))
+	}
+	// A long "extension" is shortened as part of the name
+	got = k.ResolveLpath("Author/Vol." + strings.Repeat("x", 300))
+	if name := filepath.Base(got); len(name) > maxLpathPart || !strings.HasPrefix(name, "Vol.x") {
+		t.Errorf("long extension shortened to %s (%d bytes)", name, len(name))
+	}
+}
@@ -0,0 +1,163 @@
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// calibreMDjournal records changes to the metadata cache made during a
+// session. It is compacted into calibreMDfile when Calibre disconnects.
+const calibreMDjournal = "metadata.calibre.journal"
+
+// Metadata journal operations
+const (
+	journalPut    = "put"
+	journalDelete = "delete"
+)
+
+// mdJournalEntry is a single line in the metadata journal
+type mdJournalEntry struct {
+	Op    string              `json:"op"`
+	Lpath string              `json:"lpath"`
+	Meta  *uc.CalibreBookMeta `json:"meta,omitempty"`
+	// SHA256 is the digest of the book file, if known
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// appendMDjournal appends entries to the metadata journal, and syncs it to disk
+func (k *Kobo) appendMDjournal(entries ...mdJournalEntry) error {
+	if k.DryRun() {
+		// The changes are reported by the caller
+		return nil
+	}
+	if err := k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("appendMDjournal: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(k.BKRootDir, calibreMDjournal), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("appendMDjournal: error opening journal: %w", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			return fmt.Errorf("appendMDjournal: error encoding entry for %s: %w", e.Lpath, err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("appendMDjournal: error writing journal: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("appendMDjournal: error syncing journal: %w", err)
+	}
+	return nil
+}
+
+// RecordMetadata journals the current metadata of the books with the
+// provided ContentID's
+func (k *Kobo) RecordMetadata(cids ...string) error {
+	entries := make([]mdJournalEntry, 0, len(cids))
+	for _, cid := range cids {
+		if m, exists := k.Metadata.Get(cid); exists && m.Meta != nil {
+			entries = append(entries, mdJournalEntry{Op: journalPut, Lpath: m.Meta.Lpath, Meta: m.Meta, SHA256: m.sha256})
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := k.appendMDjournal(entries...); err != nil {
+		return fmt.Errorf("RecordMetadata: %w", err)
+	}
+	return nil
+}
+
+// RecordDeletion journals the removal of a book from the metadata cache
+func (k *Kobo) RecordDeletion(lpath string) error {
+	if err := k.appendMDjournal(mdJournalEntry{Op: journalDelete, Lpath: lpath}); err != nil {
+		return fmt.Errorf("RecordDeletion: %w", err)
+	}
+	return nil
+}
+
+// replayMDjournal applies a journal left behind by a previous session, which
+// means Kobo UNCaGED did not exit cleanly. Whether a journal was replayed is
+// returned.
+func (k *Kobo) replayMDjournal() (bool, error) {
+	f, err := util.GetFileRead(filepath.Join(k.BKRootDir, calibreMDjournal))
+	if err != nil {
+		return false, fmt.Errorf("replayMDjournal: error opening journal: %w", err)
+	}
+	if f == nil {
+		return false, nil
+	}
+	defer f.Close()
+	n := 0
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e mdJournalEntry
+		if err = dec.Decode(&e); err != nil {
+			// A crash can leave a partially written last entry. Everything before it is still good.
+			log.Printf("replayMDjournal: stopping at undecodable entry: %v", err)
+			break
+		}
+		cid := util.LpathToContentID(e.Lpath, string(k.ContentIDprefix))
+		switch e.Op {
+		case journalPut:
+			if e.Meta == nil {
+				continue
+			}
+			if m, exists := k.Metadata.Get(cid); exists {
+				// The previous session may have crashed before updating the Nickel DB,
+				// so the book is updated again this session, along with the filesize
+				// of a book file it replaced
+				if e.SHA256 != "" && e.SHA256 != m.sha256 {
+					k.queueReplacedFilesize(cid, m)
+				}
+				k.Metadata.Put(cid, e.Meta)
+				k.Metadata.SetSHA256(cid, e.SHA256)
+			} else if raw, err := json.Marshal(mdRecord{CalibreBookMeta: e.Meta, SHA256: e.SHA256}); err == nil {
+				k.unmatchedMD[e.Lpath] = raw
+			}
+		case journalDelete:
+			k.Metadata.Delete(cid)
+			delete(k.unmatchedMD, e.Lpath)
+		}
+		n++
+	}
+	log.Printf("replayMDjournal: recovered %d metadata change(s) from previous session", n)
+	return true, nil
+}
+
+// queueReplacedFilesize queues the filesize of the book file of cid to be
+// written to the Nickel DB, as for a book replaced this session
+func (k *Kobo) queueReplacedFilesize(cid string, m BookMeta) {
+	fi, err := os.Stat(util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix)))
+	if err != nil {
+		log.Printf("queueReplacedFilesize: %v", err)
+		return
+	}
+	k.queueReplacedBook(cid, m, int(fi.Size()))
+}
+
+// CompactMDfile writes the full metadata cache to disk, and removes the
+// journal. Call this at the end of a session.
+func (k *Kobo) CompactMDfile() error {
+	if err := k.WriteMDfile(); err != nil {
+		return fmt.Errorf("CompactMDfile: %w", err)
+	}
+	if k.DryRun() {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(k.BKRootDir, calibreMDjournal)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("CompactMDfile: error removing journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package device
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestMDjournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	newKobo := func() *Kobo {
+		k := &Kobo{
+			DBRootDir:       dir,
+			BKRootDir:       dir,
+			ContentIDprefix: onboardPrefix,
+			Metadata:        NewMetadataStore(0),
+			unmatchedMD:     make(map[string]json.RawMessage),
+			replacedBooks:   make(map[string]int),
+		}
+		k.Metadata.set("file:///mnt/onboard/a.epub", BookMeta{})
+		k.Metadata.set("file:///mnt/onboard/b.epub", BookMeta{})
+		return k
+	}
+	k := newKobo()
+	k.Metadata.Put("file:///mnt/onboard/a.epub", &uc.CalibreBookMeta{Lpath: "a.epub", Title: "A"})
+	k.Metadata.SetSHA256("file:///mnt/onboard/a.epub", "aaaa")
+	k.Metadata.Put("file:///mnt/onboard/c.epub", &uc.CalibreBookMeta{Lpath: "c.epub", Title: "C"})
+	if err := k.RecordMetadata("file:///mnt/onboard/a.epub", "file:///mnt/onboard/c.epub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RecordDeletion("b.epub"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash, leaving a partially written entry behind
+	f, err := os.OpenFile(filepath.Join(dir, calibreMDjournal), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","lpath":"d.ep`)
+	f.Close()
+
+	if err = os.WriteFile(filepath.Join(dir, "a.epub"), []byte("new copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k = newKobo()
+	replayed, err := k.replayMDjournal()
+	if err != nil || !replayed {
+		t.Fatalf("replayMDjournal() = %v, %v, want true, nil", replayed, err)
+	}
+	if m, _ := k.Metadata.Get("file:///mnt/onboard/a.epub"); m.Meta == nil || m.Meta.Title != "A" {
+		t.Errorf("a.epub metadata not recovered")
+	} else if m.SHA256() != "aaaa" {
+		t.Errorf("a.epub digest = %q, want aaaa", m.SHA256())
+	}
+	if _, exists := k.Metadata.Get("file:///mnt/onboard/b.epub"); exists {
+		t.Errorf("b.epub deletion not recovered")
+	}
+	if _, exists := k.unmatchedMD["c.epub"]; !exists {
+		t.Errorf("c.epub not kept for a book missing from the DB")
+	}
+	// The recovered changes still have to reach the Nickel DB
+	if !k.Metadata.Changed("file:///mnt/onboard/a.epub") || k.Metadata.ChangedCount() != 1 {
+		t.Errorf("a.epub not queued for the metadata update, %d change(s)", k.Metadata.ChangedCount())
+	}
+	if size := k.replacedBooks["file:///mnt/onboard/a.epub"]; size != len("new copy") {
+		t.Errorf("a.epub filesize update = %d, want %d", size, len("new copy"))
+	}
+}
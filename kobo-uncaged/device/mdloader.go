@@ -0,0 +1,161 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// maxMetadataWorkers bounds how many book files are parsed at once. Parsing is
+// mostly waiting on storage, so a few workers help even on single core devices.
+const maxMetadataWorkers = 4
+
+// dbBookMeta is the metadata Nickel has for a book without a metadata.calibre record
+type dbBookMeta struct {
+	title, attr, desc, publisher, series, seriesNum *string
+}
+
+// loadedMeta is the metadata built for a book by a worker
+type loadedMeta struct {
+	cid string
+	md  *uc.CalibreBookMeta
+}
+
+// readDBBookMeta gets the Nickel metadata of every book in the metadata cache
+// that has no metadata yet, using a single query
+func (k *Kobo) readDBBookMeta(nickelDB *sql.DB, queryFrom, cidLike string) (map[string]dbBookMeta, error) {
+	dbMeta := make(map[string]dbBookMeta)
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		if m.Meta == nil {
+			dbMeta[cid] = dbBookMeta{}
+		}
+		return true
+	})
+	if len(dbMeta) == 0 {
+		return dbMeta, nil
+	}
+	rows, err := nickelDB.Query(`SELECT ContentID, Title, Attribution, Description, Publisher, Series, SeriesNumber`+queryFrom, cidLike)
+	if err != nil {
+		return nil, fmt.Errorf("readDBBookMeta: error getting book metadata rows: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid string
+		// RawBytes avoids copying the columns of books that already have metadata
+		var cols [6]sql.RawBytes
+		if err = rows.Scan(&cid, &cols[0], &cols[1], &cols[2], &cols[3], &cols[4], &cols[5]); err != nil {
+			return nil, fmt.Errorf("readDBBookMeta: book metadata row decoding error: %w", err)
+		}
+		if _, needed := dbMeta[cid]; !needed {
+			continue
+		}
+		var db dbBookMeta
+		for i, dst := range []**string{&db.title, &db.attr, &db.desc, &db.publisher, &db.series, &db.seriesNum} {
+			if cols[i] != nil {
+				s := string(cols[i])
+				*dst = &s
+			}
+		}
+		dbMeta[cid] = db
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("readDBBookMeta: book metadata rows error: %w", err)
+	}
+	return dbMeta, nil
+}
+
+// loadUncachedMeta builds metadata for books without a metadata.calibre
+// record, parsing their book files on a bounded pool of workers. Progress is
+// sent to the web UI as books are done.
+func (k *Kobo) loadUncachedMeta(dbMeta map[string]dbBookMeta) {
+	if len(dbMeta) == 0 {
+		return
+	}
+	if k.BrowserOpen {
+		k.WebSend(WebMsg{ShowMessage: fmt.Sprintf("Reading metadata from %d book files", len(dbMeta)), Progress: 0})
+	}
+	jobs := make(chan string)
+	results := make(chan loadedMeta)
+	var wg sync.WaitGroup
+	for i := 0; i < min(runtime.NumCPU()*2, maxMetadataWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cid := range jobs {
+				results <- loadedMeta{cid: cid, md: k.buildBookMeta(cid, dbMeta[cid])}
+			}
+		}()
+	}
+	go func() {
+		for cid := range dbMeta {
+			jobs <- cid
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	// Results are collected here, so WebSend is only ever called from this goroutine
+	n, lastProgress := 0, 0
+	for res := range results {
+		if m, exists := k.Metadata.Get(res.cid); exists {
+			m.Meta = res.md
+			k.Metadata.set(res.cid, m)
+		}
+		n++
+		if p := n * 100 / len(dbMeta); p != lastProgress && k.BrowserOpen {
+			k.WebSend(WebMsg{Progress: p})
+			lastProgress = p
+		}
+	}
+}
+
+// buildBookMeta builds the metadata of a book from its file and the Nickel DB.
+// It is safe to call from multiple goroutines.
+func (k *Kobo) buildBookMeta(cid string, db dbBookMeta) *uc.CalibreBookMeta {
+	var bkMD uc.CalibreBookMeta
+	if err := k.readBookMeta(cid, &bkMD); err != nil {
+		k.DebugLogPrintf("Unable to read metadata from book file: %v", err)
+	}
+	bkMD.Lpath = util.ContentIDtoLpath(cid, string(k.ContentIDprefix))
+	// Values from the DB are what the user sees on the device, so take precedence
+	// over those read from the book file. Nickel doesn't get everything from
+	// every format though, so don't clear what the file provided. For other
+	// formats than epub, Nickel often only has the file name as title, so the
+	// title and authors found in the file win.
+	fileWins := !strings.HasSuffix(strings.ToLower(cid), ".epub")
+	if db.desc != nil && *db.desc != "" {
+		bkMD.Comments = db.desc
+	}
+	if db.publisher != nil && *db.publisher != "" {
+		bkMD.Publisher = db.publisher
+	}
+	if db.series != nil && *db.series != "" {
+		bkMD.Series = db.series
+		bkMD.SeriesIndex = nil
+	}
+	if db.title != nil && (bkMD.Title == "" || *db.title != "" && !fileWins) {
+		bkMD.Title = *db.title
+	}
+	if db.seriesNum != nil {
+		index, err := strconv.ParseFloat(*db.seriesNum, 64)
+		if err == nil {
+			bkMD.SeriesIndex = &index
+		}
+	}
+	if db.attr != nil && *db.attr != "" && (len(bkMD.Authors) == 0 || !fileWins) {
+		bkMD.Authors = strings.Split(*db.attr, ",")
+		for i := range bkMD.Authors {
+			bkMD.Authors[i] = strings.TrimSpace(bkMD.Authors[i])
+		}
+	}
+	if bkMD.UUID == "" {
+		bkMD.UUID = stableBookUUID(cid, util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix)))
+	}
+	return &bkMD
+}
@@ -0,0 +1,136 @@
+package device
+
+import (
+	"sync"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// bookChange records how a book in the metadata store changed this session
+type bookChange int
+
+const (
+	bookUnchanged bookChange = iota
+	bookUpdated
+	bookNew
+)
+
+// MetadataStore is the metadata cache of sideloaded books, keyed by ContentID.
+// It is safe for concurrent use, and keeps track of which books were added
+// or updated during the session.
+type MetadataStore struct {
+	mu      sync.RWMutex
+	books   map[string]BookMeta
+	changes map[string]bookChange
+}
+
+// NewMetadataStore creates an empty metadata store, with room for sizeHint books
+func NewMetadataStore(sizeHint int) *MetadataStore {
+	return &MetadataStore{
+		books:   make(map[string]BookMeta, sizeHint),
+		changes: make(map[string]bookChange),
+	}
+}
+
+// Get the metadata of a book
+func (s *MetadataStore) Get(cid string) (BookMeta, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, exists := s.books[cid]
+	return m, exists
+}
+
+// Put sets the Calibre metadata of a book, keeping any state read from the
+// Nickel DB. The book is recorded as new or updated.
+func (s *MetadataStore) Put(cid string, md *uc.CalibreBookMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, exists := s.books[cid]
+	if !exists {
+		s.changes[cid] = bookNew
+	} else if s.changes[cid] == bookUnchanged {
+		s.changes[cid] = bookUpdated
+	}
+	m.Meta = md
+	s.books[cid] = m
+}
+
+// SetSHA256 records the digest of a book file
+func (s *MetadataStore) SetSHA256(cid, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, exists := s.books[cid]; exists {
+		m.sha256 = digest
+		s.books[cid] = m
+	}
+}
+
+// setState copies the state read from the Nickel DB of from to the book cid
+func (s *MetadataStore) setState(cid string, from BookMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, exists := s.books[cid]; exists {
+		m.reading, m.annotations = from.reading, from.annotations
+		s.books[cid] = m
+	}
+}
+
+// set stores a book without recording a change. It is used while loading
+// the cache.
+func (s *MetadataStore) set(cid string, m BookMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.books[cid] = m
+}
+
+// Delete removes a book from the store
+func (s *MetadataStore) Delete(cid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.books, cid)
+	delete(s.changes, cid)
+}
+
+// Iterate calls fn for each book, until fn returns false. It iterates over a
+// snapshot of the store, so fn may safely modify the store.
+func (s *MetadataStore) Iterate(fn func(cid string, m BookMeta) bool) {
+	s.mu.RLock()
+	snapshot := make(map[string]BookMeta, len(s.books))
+	for cid, m := range s.books {
+		snapshot[cid] = m
+	}
+	s.mu.RUnlock()
+	for cid, m := range snapshot {
+		if !fn(cid, m) {
+			return
+		}
+	}
+}
+
+// Len returns the number of books in the store
+func (s *MetadataStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.books)
+}
+
+// Changed reports whether a book was added or updated this session
+func (s *MetadataStore) Changed(cid string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changes[cid] != bookUnchanged
+}
+
+// IsNew reports whether a book was added this session
+func (s *MetadataStore) IsNew(cid string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changes[cid] == bookNew
+}
+
+// ChangedCount returns the number of books added or updated this session
+func (s *MetadataStore) ChangedCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.changes)
+}
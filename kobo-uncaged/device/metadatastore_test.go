@@ -0,0 +1,72 @@
+package device
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestMetadataStore(t *testing.T) {
+	s := NewMetadataStore(0)
+	rs := &readingState{readStatus: 1}
+	s.set("existing", BookMeta{Meta: &uc.CalibreBookMeta{Title: "Old"}, reading: rs})
+	s.set("deleted", BookMeta{Meta: &uc.CalibreBookMeta{Title: "Deleted"}})
+	if s.ChangedCount() != 0 {
+		t.Errorf("loaded books recorded as changed")
+	}
+
+	s.Put("existing", &uc.CalibreBookMeta{Title: "Updated"})
+	s.Put("new", &uc.CalibreBookMeta{Title: "New"})
+	s.Put("new", &uc.CalibreBookMeta{Title: "New again"})
+	s.Delete("deleted")
+
+	if m, ok := s.Get("existing"); !ok || m.Meta.Title != "Updated" || m.reading != rs {
+		t.Errorf("Put did not update metadata and keep the reading state")
+	}
+	if !s.Changed("existing") || s.IsNew("existing") {
+		t.Errorf("existing book not recorded as updated")
+	}
+	if !s.IsNew("new") {
+		t.Errorf("new book not recorded as new after a second Put")
+	}
+	if _, ok := s.Get("deleted"); ok || s.Changed("deleted") {
+		t.Errorf("deleted book still in store")
+	}
+	if s.Len() != 2 || s.ChangedCount() != 2 {
+		t.Errorf("Len() = %d, ChangedCount() = %d, want 2, 2", s.Len(), s.ChangedCount())
+	}
+	// Modifying the store while iterating must not deadlock
+	s.Iterate(func(cid string, m BookMeta) bool {
+		s.Delete(cid)
+		return true
+	})
+	if s.Len() != 0 {
+		t.Errorf("Len() = %d after deleting every book, want 0", s.Len())
+	}
+}
+
+func TestMetadataStoreConcurrent(t *testing.T) {
+	s := NewMetadataStore(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cid := fmt.Sprintf("%d-%d", i, j)
+				s.Put(cid, &uc.CalibreBookMeta{Title: cid})
+				s.Get(cid)
+				s.Iterate(func(string, BookMeta) bool { return false })
+				if j%2 == 0 {
+					s.Delete(cid)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if s.Len() != 400 || s.ChangedCount() != 400 {
+		t.Errorf("Len() = %d, ChangedCount() = %d, want 400, 400", s.Len(), s.ChangedCount())
+	}
+}
@@ -0,0 +1,170 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// mobiUTF8 is the MOBI header text encoding for UTF-8. Anything else is
+// treated as Windows-1252.
+const mobiUTF8 = 65001
+
+// EXTH record types that map to Calibre metadata
+const (
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthISBN        = 104
+	exthSubject     = 105
+	exthPubdate     = 106
+	exthSource      = 112
+	exthASIN        = 113
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+// cp1252 maps the bytes where Windows-1252 differs from Latin-1
+var cp1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// readMOBIMeta reads the title and EXTH metadata from the MOBI header of
+// the first record of a MOBI file
+func readMOBIMeta(bkPath string, md *uc.CalibreBookMeta) error {
+	f, err := os.Open(bkPath)
+	if err != nil {
+		return fmt.Errorf("readMOBIMeta: error opening mobi: %w", err)
+	}
+	defer f.Close()
+	if err = parseMOBI(f, md); err != nil {
+		return fmt.Errorf("readMOBIMeta: %w", err)
+	}
+	return nil
+}
+
+// parseMOBI implements readMOBIMeta
+func parseMOBI(r io.ReaderAt, md *uc.CalibreBookMeta) error {
+	// The PDB header is followed by the record list. Only the offset of the first record is needed.
+	var pdb [86]byte
+	if _, err := r.ReadAt(pdb[:], 0); err != nil {
+		return fmt.Errorf("parseMOBI: error reading PDB header: %w", err)
+	}
+	if string(pdb[60:68]) != "BOOKMOBI" {
+		return fmt.Errorf("parseMOBI: not a MOBI file")
+	}
+	rec0 := int64(binary.BigEndian.Uint32(pdb[78:]))
+	// Record 0 is the PalmDOC header, followed by the MOBI header and EXTH
+	var hdr [132]byte
+	if _, err := r.ReadAt(hdr[:], rec0); err != nil {
+		return fmt.Errorf("parseMOBI: error reading MOBI header: %w", err)
+	}
+	if string(hdr[16:20]) != "MOBI" {
+		return fmt.Errorf("parseMOBI: MOBI header not found")
+	}
+	mobiLen := int64(binary.BigEndian.Uint32(hdr[20:]))
+	encoding := binary.BigEndian.Uint32(hdr[28:])
+	decode := func(b []byte) string {
+		return strings.TrimSpace(decodeMOBIText(b, encoding))
+	}
+	nameOff, nameLen := int64(binary.BigEndian.Uint32(hdr[84:])), binary.BigEndian.Uint32(hdr[88:])
+	if nameLen > 0 && nameLen < 4096 {
+		name := make([]byte, nameLen)
+		if _, err := r.ReadAt(name, rec0+nameOff); err == nil {
+			md.Title = decode(name)
+		}
+	}
+	if binary.BigEndian.Uint32(hdr[128:])&0x40 == 0 {
+		// No EXTH header
+		return nil
+	}
+	exthOff := rec0 + 16 + mobiLen
+	var exthHdr [12]byte
+	if _, err := r.ReadAt(exthHdr[:], exthOff); err != nil {
+		return fmt.Errorf("parseMOBI: error reading EXTH header: %w", err)
+	}
+	if string(exthHdr[:4]) != "EXTH" {
+		return fmt.Errorf("parseMOBI: EXTH header not found")
+	}
+	exthLen := binary.BigEndian.Uint32(exthHdr[4:])
+	if exthLen < 12 || exthLen > 1<<20 {
+		return fmt.Errorf("parseMOBI: invalid EXTH header length")
+	}
+	exth := make([]byte, exthLen-12)
+	if _, err := r.ReadAt(exth, exthOff+12); err != nil {
+		return fmt.Errorf("parseMOBI: error reading EXTH records: %w", err)
+	}
+	count := binary.BigEndian.Uint32(exthHdr[8:])
+	var authors, subjects []string
+	for i := uint32(0); i < count && len(exth) >= 8; i++ {
+		recType, recLen := binary.BigEndian.Uint32(exth), binary.BigEndian.Uint32(exth[4:])
+		if recLen < 8 || int(recLen) > len(exth) {
+			break
+		}
+		val := decode(exth[8:recLen])
+		exth = exth[recLen:]
+		if val == "" {
+			continue
+		}
+		switch recType {
+		case exthAuthor:
+			authors = append(authors, splitNames(val, "&;")...)
+		case exthPublisher:
+			md.Publisher = &val
+		case exthDescription:
+			md.Comments = &val
+		case exthISBN:
+			setIdentifier(md, "isbn", val)
+		case exthSubject:
+			subjects = append(subjects, splitNames(val, ";")...)
+		case exthPubdate:
+			if pd := parseLooseTime(val); pd != nil {
+				md.Pubdate = pd
+			}
+		case exthSource:
+			// Calibre stores the book UUID here
+			if strings.HasPrefix(val, "calibre:") {
+				setIdentifier(md, "calibre", strings.TrimPrefix(val, "calibre:"))
+			} else if strings.HasPrefix(strings.ToLower(val), "urn:isbn:") {
+				setIdentifier(md, "isbn", val[len("urn:isbn:"):])
+			}
+		case exthASIN:
+			setIdentifier(md, "mobi-asin", val)
+		case exthTitle:
+			md.Title = val
+		case exthLanguage:
+			md.Languages = []string{val}
+		}
+	}
+	if len(authors) > 0 {
+		md.Authors = authors
+	}
+	if len(subjects) > 0 {
+		md.Tags = subjects
+	}
+	return nil
+}
+
+// decodeMOBIText decodes text in the encoding given in the MOBI header
+func decodeMOBIText(b []byte, encoding uint32) string {
+	b = bytes.TrimRight(b, "\x00")
+	if encoding == mobiUTF8 && utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		if c >= 0x80 && c < 0xa0 {
+			r[i] = cp1252[c-0x80]
+		} else {
+			r[i] = rune(c)
+		}
+	}
+	return string(r)
+}
@@ -0,0 +1,162 @@
+package device
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// contentIDcolumns are the columns of the Nickel DB that refer to a book, or
+// to one of its chapters, by ContentID. Columns missing from the DB are skipped.
+var contentIDcolumns = []struct{ table, col string }{
+	{"content", "ContentID"},
+	{"content", "BookID"},
+	{"Bookmark", "ContentID"},
+	{"Bookmark", "VolumeID"},
+	{"ShelfContent", "ContentId"},
+	{"volume_shortcovers", "volumeId"},
+	{"volume_shortcovers", "shortcoverId"},
+	{"volume_tabs", "volumeid"},
+	{"volume_tabs", "tabId"},
+	{"content_keys", "volumeId"},
+	{"content_keys", "elementId"},
+	{"Event", "ContentID"},
+	{"Activity", "Id"},
+}
+
+// deletedBook is a book Calibre deleted this session
+type deletedBook struct {
+	cid string
+	m   BookMeta
+}
+
+// receivedBook is a book Calibre sent this session, that was not already on
+// the device
+type receivedBook struct {
+	cid  string
+	size int
+}
+
+// bookMove is a book Calibre moved to a new lpath, by deleting it and sending
+// it again
+type bookMove struct {
+	from, to string
+	size     int
+	old      BookMeta
+}
+
+// TrackDeletedBook remembers a book Calibre is deleting, in case Calibre is
+// moving it. Call it before the book is removed from the metadata store.
+func (k *Kobo) TrackDeletedBook(cid string) {
+	if m, exists := k.Metadata.Get(cid); exists && m.Meta != nil && m.Meta.UUID != "" {
+		k.deletedBooks[m.Meta.UUID] = deletedBook{cid: cid, m: m}
+	}
+}
+
+// TrackReceivedBook remembers a book Calibre sent, in case Calibre is moving
+// it. Call it before the book is added to the metadata store.
+func (k *Kobo) TrackReceivedBook(cid string, md *uc.CalibreBookMeta, size int) {
+	if _, exists := k.Metadata.Get(cid); !exists && md.UUID != "" {
+		k.receivedBooks[md.UUID] = receivedBook{cid: cid, size: size}
+	}
+}
+
+// bookMoves pairs up the books deleted and received this session that share a
+// Calibre UUID. Calibre moves a book this way when its author or title changes.
+func (k *Kobo) bookMoves() []bookMove {
+	var moves []bookMove
+	for id, d := range k.deletedBooks {
+		if r, exists := k.receivedBooks[id]; exists && r.cid != d.cid {
+			moves = append(moves, bookMove{from: d.cid, to: r.cid, size: r.size, old: d.m})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].from < moves[j].from
+	})
+	return moves
+}
+
+// updateMovedBooks rewrites the ContentID of books Calibre moved, so their
+// reading position, bookmarks and collections follow them. It must run before
+// Nickel rescans the library, otherwise Nickel imports the book as a new one.
+func (k *Kobo) updateMovedBooks(moves []bookMove) error {
+	if err := k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("updateMovedBooks: %w", err)
+	}
+	nickelDB, err := k.openNickelDB(false)
+	if err != nil {
+		return fmt.Errorf("updateMovedBooks: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateMovedBooks: %w", err)
+	}
+	tx, err := k.beginTx(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateMovedBooks: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var moved []bookMove
+	for _, mv := range moves {
+		ok, err := moveContentID(tx, caps, mv)
+		if err != nil {
+			return fmt.Errorf("updateMovedBooks: %w", err)
+		}
+		if ok {
+			log.Printf("updateMovedBooks: moved %s to %s", mv.from, mv.to)
+			moved = append(moved, mv)
+		}
+	}
+	if err = k.commitTx(tx, fmt.Sprintf("move %d book(s) to their new lpath", len(moved))); err != nil {
+		return fmt.Errorf("updateMovedBooks: failed to commit transaction: %w", err)
+	}
+	// The reading state read from the DB belongs to the moved book now
+	for _, mv := range moved {
+		k.Metadata.setState(mv.to, mv.old)
+	}
+	return nil
+}
+
+// moveContentID rewrites the ContentID of a book and its chapters from
+// mv.from to mv.to. Books missing from the DB, and books that would replace
+// another book, are not moved.
+func moveContentID(tx *nickelTx, caps *nickelCaps, mv bookMove) (bool, error) {
+	var oldCount, newCount int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM content WHERE ContentID=? AND ContentType=6;`, mv.from).Scan(&oldCount); err != nil {
+		return false, fmt.Errorf("moveContentID: error checking %s: %w", mv.from, err)
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM content WHERE ContentID=? AND ContentType=6;`, mv.to).Scan(&newCount); err != nil {
+		return false, fmt.Errorf("moveContentID: error checking %s: %w", mv.to, err)
+	}
+	if oldCount == 0 || newCount > 0 {
+		log.Printf("moveContentID: not moving %s to %s: book missing from the DB, or destination in use", mv.from, mv.to)
+		return false, nil
+	}
+	// Chapter ContentIDs are the ContentID of the book, followed by '#' or '!'
+	n := utf8.RuneCountInString(mv.from)
+	for _, c := range contentIDcolumns {
+		if !caps.hasColumn(c.table, c.col) {
+			continue
+		}
+		query := fmt.Sprintf(`UPDATE "%[1]s" SET "%[2]s" = ? || substr("%[2]s", ?)
+			WHERE "%[2]s" = ? OR (substr("%[2]s", 1, ?) = ? AND substr("%[2]s", ?, 1) IN ('#', '!'));`, c.table, c.col)
+		if _, err := tx.Exec(query, mv.to, n+1, mv.from, n, mv.from, n+1); err != nil {
+			return false, fmt.Errorf("moveContentID: error updating %s.%s: %w", c.table, c.col, err)
+		}
+	}
+	// The new copy of the book may differ from the old one
+	if _, err := tx.Exec(`UPDATE content SET ___FileSize=? WHERE ContentID=? AND ContentType=6;`, mv.size, mv.to); err != nil {
+		return false, fmt.Errorf("moveContentID: error updating filesize of %s: %w", mv.to, err)
+	}
+	if caps.hasColumn("content", "ImageId") {
+		if _, err := tx.Exec(`UPDATE content SET ImageId=? WHERE ContentID=? AND ContentType=6;`, kobo.ContentIDToImageID(mv.to), mv.to); err != nil {
+			return false, fmt.Errorf("moveContentID: error updating ImageId of %s: %w", mv.to, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestUpdateMovedBooks(t *testing.T) {
+	dir, db := newTestNickelDB(t, `CREATE TABLE DbVersion (version INTEGER); INSERT INTO DbVersion VALUES (170);
+		CREATE TABLE content (ContentID TEXT, ContentType INT, BookID TEXT, ___FileSize INT, ___PercentRead INT);
+		CREATE TABLE Bookmark (BookmarkID TEXT, VolumeID TEXT, ContentID TEXT);
+		CREATE TABLE ShelfContent (ShelfName TEXT, ContentId TEXT);
+		INSERT INTO content VALUES ('file:///mnt/onboard/Old/Book.kepub.epub', 6, NULL, 100, 42),
+			('file:///mnt/onboard/Old/Book.kepub.epub!OEBPS!ch1.xhtml', 9, 'file:///mnt/onboard/Old/Book.kepub.epub', 0, 0),
+			('file:///mnt/onboard/Old/Book.kepub.epub.epub', 6, NULL, 50, 0);
+		INSERT INTO Bookmark VALUES ('b1', 'file:///mnt/onboard/Old/Book.kepub.epub', 'file:///mnt/onboard/Old/Book.kepub.epub!OEBPS!ch1.xhtml');
+		INSERT INTO ShelfContent VALUES ('Shelf', 'file:///mnt/onboard/Old/Book.kepub.epub');`)
+
+	k := &Kobo{
+		DBRootDir:     dir,
+		BKRootDir:     dir,
+		Metadata:      NewMetadataStore(1),
+		deletedBooks:  make(map[string]deletedBook),
+		receivedBooks: make(map[string]receivedBook),
+	}
+	from, to := "file:///mnt/onboard/Old/Book.kepub.epub", "file:///mnt/onboard/New/Book.kepub.epub"
+	rs := &readingState{readStatus: 1}
+	k.Metadata.set(from, BookMeta{Meta: &uc.CalibreBookMeta{UUID: "u1", Lpath: "Old/Book.kepub.epub"}, reading: rs})
+	k.TrackDeletedBook(from)
+	k.Metadata.Delete(from)
+	md := &uc.CalibreBookMeta{UUID: "u1", Lpath: "New/Book.kepub.epub"}
+	k.TrackReceivedBook(to, md, 120)
+	k.Metadata.Put(to, md)
+
+	moves := k.bookMoves()
+	if len(moves) != 1 || moves[0].from != from || moves[0].to != to {
+		t.Fatalf("bookMoves() = %v, want one move from %s to %s", moves, from, to)
+	}
+	if err := k.updateMovedBooks(moves); err != nil {
+		t.Fatal(err)
+	}
+	var percent, size int
+	if err := db.QueryRow(`SELECT ___PercentRead, ___FileSize FROM content WHERE ContentID=? AND ContentType=6;`, to).Scan(&percent, &size); err != nil || percent != 42 || size != 120 {
+		t.Errorf("moved book = %d%%, %d bytes, %v, want 42%%, 120 bytes", percent, size, err)
+	}
+	for query, want := range map[string]string{
+		`SELECT BookID FROM content WHERE ContentType=9;`:    to,
+		`SELECT ContentID FROM content WHERE ContentType=9;`: to + "!OEBPS!ch1.xhtml",
+		`SELECT ContentID FROM Bookmark;`:                    to + "!OEBPS!ch1.xhtml",
+		`SELECT VolumeID FROM Bookmark;`:                     to,
+		`SELECT ContentId FROM ShelfContent;`:                to,
+	} {
+		var got string
+		if err := db.QueryRow(query).Scan(&got); err != nil || got != want {
+			t.Errorf("%s = %q, %v, want %q", query, got, err, want)
+		}
+	}
+	// A book whose ContentID starts with that of the moved book is left alone
+	if err := db.QueryRow(`SELECT ___FileSize FROM content WHERE ContentID='file:///mnt/onboard/Old/Book.kepub.epub.epub';`).Scan(&size); err != nil {
+		t.Errorf("unrelated book was moved: %v", err)
+	}
+	if m, _ := k.Metadata.Get(to); m.reading != rs {
+		t.Errorf("reading state did not follow the moved book")
+	}
+}
@@ -0,0 +1,399 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/godbus/dbus/v5"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// How long to wait for Nickel to finish a library rescan. Importing a large
+// number of new books can take some time.
+const rescanTimeout = 5 * time.Minute
+
+// The timestamp format Nickel uses in its database
+const nickelTimeFormat = "2006-01-02T15:04:05Z"
+
+// openNickelDB opens the Nickel database. Read-only connections are used while
+// Calibre is connected, a writable connection is only required when updating
+// the DB after the session has ended. A dry run never opens it writable.
+func (k *Kobo) openNickelDB(readOnly bool) (*sql.DB, error) {
+	dsn := "file:" + filepath.Join(k.DBRootDir, koboDBpath)
+	if readOnly || k.DryRun() {
+		dsn += "?_timeout=2000&_journal=WAL&mode=ro&_mutex=full&_sync=NORMAL"
+	} else {
+		// Don't change the journal mode here. That's Nickel's business.
+		dsn += "?_timeout=5000&_mutex=full&_txlock=immediate"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("openNickelDB: sql open failed: %w", err)
+	}
+	return db, nil
+}
+
+// rescanLibrary asks Nickel to perform a full library rescan, and waits
+// for it to finish. Without NickelDBus the library can't be rescanned, which
+// the user is warned about.
+func (k *Kobo) rescanLibrary() error {
+	if !k.useNDB {
+		if !k.rescanWarned {
+			k.rescanWarned = true
+			k.Warn("NickelDBus is disabled, so the library was not rescanned. New books are not imported, and deleted books not removed, until the Kobo next rescans its library.")
+		}
+		return nil
+	}
+	if k.DryRun() {
+		k.DryRunf("would run a library rescan")
+		return nil
+	}
+	// Only the end of this rescan is waited for. Rescans Nickel started itself
+	// earlier in the session are ignored.
+	done := make(chan bool, 1)
+	k.rescanMu.Lock()
+	k.rescanDone = done
+	k.rescanMu.Unlock()
+	defer func() {
+		k.rescanMu.Lock()
+		k.rescanDone = nil
+		k.rescanMu.Unlock()
+	}()
+	if err := k.ndbConn.AddMatchSignal(rescanDoneMatch()...); err != nil {
+		return fmt.Errorf("rescanLibrary: error adding pfmDoneProcessing match signal: %w", err)
+	}
+	defer k.ndbConn.RemoveMatchSignal(rescanDoneMatch()...)
+	if err := k.ndbObj.Call(ndbInterface+".pfmRescanBooksFull", 0).Err; err != nil {
+		return fmt.Errorf("rescanLibrary: failed to start library rescan: %w", err)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(rescanTimeout):
+		return fmt.Errorf("rescanLibrary: timeout waiting for library rescan to finish")
+	}
+}
+
+// rescanDoneMatch matches the signal NickelDBus sends when a rescan finishes
+func rescanDoneMatch() []dbus.MatchOption {
+	return []dbus.MatchOption{dbus.WithMatchObjectPath("/nickeldbus"),
+		dbus.WithMatchInterface(ndbInterface),
+		dbus.WithMatchMember("pfmDoneProcessing")}
+}
+
+// rescanFinished passes the end of a library rescan on to rescanLibrary, if
+// it is waiting for one
+func (k *Kobo) rescanFinished() {
+	k.rescanMu.Lock()
+	defer k.rescanMu.Unlock()
+	if k.rescanDone != nil {
+		select {
+		case k.rescanDone <- true:
+		default:
+		}
+	}
+}
+
+// Warn logs a warning, and shows it in the web UI if it is still open
+func (k *Kobo) Warn(msg string) {
+	log.Println(msg)
+	if k.BrowserOpen {
+		k.WebSend(WebMsg{Warning: msg, Progress: IgnoreProgress})
+	}
+}
+
+// updateStatus shows a status message in the web UI, if it is still open
+func (k *Kobo) updateStatus(msg string, progress int) {
+	log.Println(msg)
+	if k.BrowserOpen {
+		k.WebSend(WebMsg{ShowMessage: msg, Progress: progress})
+	}
+}
+
+// UpdateNickelDB updates the Nickel database with the changes made this
+// session. Replaced books have their filesize updated before the library is
+// rescanned, and the metadata of all books is updated in a single transaction
+// after Nickel has imported any new books. The number of books successfully
+// and unsuccessfully updated is returned.
+func (k *Kobo) UpdateNickelDB() (updated, failed int, err error) {
+	if moves := k.bookMoves(); len(moves) > 0 {
+		k.updateStatus("Moving renamed book(s)", -1)
+		if err = k.updateMovedBooks(moves); err != nil {
+			return 0, 0, fmt.Errorf("UpdateNickelDB: %w", err)
+		}
+	}
+	if len(k.replacedBooks) > 0 {
+		k.updateStatus("Updating replacement book filesize(s)", -1)
+		if err = k.updateReplacedBooks(); err != nil {
+			return 0, 0, fmt.Errorf("UpdateNickelDB: %w", err)
+		}
+		k.removeStaleCovers()
+	}
+	// Always run library rescan, just in case. Especially to catch book deletion
+	k.updateStatus("Running library rescan", -1)
+	if err = k.rescanLibrary(); err != nil {
+		return 0, 0, fmt.Errorf("UpdateNickelDB: %w", err)
+	}
+	// Books that were waiting to be imported may now be in the DB
+	if err = k.reconcileUnmatchedMD(); err != nil {
+		return 0, 0, fmt.Errorf("UpdateNickelDB: %w", err)
+	}
+	changed := k.Metadata.ChangedCount() > 0
+	if changed {
+		k.updateStatus("Updating metadata", 0)
+		if err = k.updateMetadata(); err != nil {
+			return 0, 0, fmt.Errorf("UpdateNickelDB: %w", err)
+		}
+		for _, res := range k.updateResults {
+			if res.Err != "" {
+				failed++
+			} else {
+				updated++
+			}
+		}
+	}
+	// Collections are refreshed every session, as deleted books may have left
+	// collections empty
+	if libOpts, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists && libOpts.CollectionsColumn != "" {
+		k.updateStatus("Updating collections", -1)
+		collectionsChanged, err := k.updateCollections()
+		if err != nil {
+			return updated, failed, fmt.Errorf("UpdateNickelDB: %w", err)
+		}
+		changed = changed || collectionsChanged
+	}
+	if !changed {
+		return 0, 0, nil
+	}
+	k.updateStatus("Running library rescan after metadata update", -1)
+	if err = k.rescanLibrary(); err != nil {
+		return updated, failed, fmt.Errorf("UpdateNickelDB: %w", err)
+	}
+	return updated, failed, nil
+}
+
+// setOptionalFields adds the fields the user has chosen to overwrite to rec.
+// Fields without a value in Calibre are left as Nickel has them.
+func (k *Kobo) setOptionalFields(rec goqu.Record, md *uc.CalibreBookMeta) {
+	fields := k.KuConfig.MetadataFields
+	if fields.Title && md.Title != "" {
+		rec["Title"] = md.Title
+	}
+	if fields.Authors && len(md.Authors) > 0 {
+		rec["Attribution"] = strings.Join(md.Authors, ", ")
+	}
+	if fields.Publisher && md.PubString() != "" {
+		rec["Publisher"] = md.PubString()
+	}
+	if fields.Language && len(md.Languages) > 0 {
+		if lang := util.LangToISO6391(md.Languages[0]); lang != "" {
+			rec["Language"] = lang
+		}
+	}
+	if fields.ISBN {
+		if isbn, exists := md.Identifiers["isbn"]; exists && isbn != "" {
+			rec["ISBN"] = isbn
+		}
+	}
+	if fields.Pubdate {
+		if pd := md.Pubdate.GetTime(); pd != nil {
+			rec["DateCreated"] = pd.UTC().Format(nickelTimeFormat)
+		}
+	}
+}
+
+// updateReplacedBooks sets the new filesize of replaced books, so Nickel
+// does not treat them as new books when rescanning. Chapters that moved in
+// replaced kepubs are remapped, so bookmarks stay attached to them.
+func (k *Kobo) updateReplacedBooks() error {
+	if err := k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("updateReplacedBooks: %w", err)
+	}
+	nickelDB, err := k.openNickelDB(false)
+	if err != nil {
+		return fmt.Errorf("updateReplacedBooks: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateReplacedBooks: %w", err)
+	}
+	tx, err := k.beginTx(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateReplacedBooks: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dialect := goqu.Dialect("sqlite3")
+	for cid, size := range k.replacedBooks {
+		ds := dialect.Update("content").Prepared(true).Set(goqu.Record{"___FileSize": size}).Where(goqu.Ex{"ContentID": cid, "ContentType": 6})
+		sqlStr, args, err := ds.ToSQL()
+		if err != nil {
+			return fmt.Errorf("updateReplacedBooks: failed to build query: %w", err)
+		}
+		if _, err = tx.Exec(sqlStr, args...); err != nil {
+			return fmt.Errorf("updateReplacedBooks: failed to update %s: %w", cid, err)
+		}
+		if r, exists := k.chapterRemaps[cid]; exists {
+			var lpath string
+			if m, exists := k.Metadata.Get(cid); exists && m.Meta != nil {
+				lpath = m.Meta.Lpath
+			}
+			orphaned, err := remapChapters(tx, caps, cid, lpath, r)
+			if err != nil {
+				return fmt.Errorf("updateReplacedBooks: %w", err)
+			}
+			for _, o := range orphaned {
+				log.Printf("updateReplacedBooks: annotation in %s of %s could not be reattached: %s", o.Chapter, o.Lpath, o.Text)
+			}
+			k.orphaned = append(k.orphaned, orphaned...)
+		}
+	}
+	if err = k.commitTx(tx, fmt.Sprintf("update the filesize of %d replaced book(s)", len(k.replacedBooks))); err != nil {
+		return fmt.Errorf("updateReplacedBooks: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// updateMetadata writes the metadata of every book to the Nickel database.
+// A failure to update one book does not prevent the rest from being updated,
+// and the outcome of each new or updated book is recorded for the web UI.
+func (k *Kobo) updateMetadata() error {
+	if err := k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("updateMetadata: %w", err)
+	}
+	nickelDB, err := k.openNickelDB(false)
+	if err != nil {
+		return fmt.Errorf("updateMetadata: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateMetadata: %w", err)
+	}
+	tx, err := k.beginTx(nickelDB)
+	if err != nil {
+		return fmt.Errorf("updateMetadata: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dialect := goqu.Dialect("sqlite3")
+	useSeriesID := caps.seriesID()
+	var seriesMatches map[string]seriesMatch
+	if useSeriesID {
+		store, err := readStoreSeries(tx)
+		if err != nil {
+			return fmt.Errorf("updateMetadata: %w", err)
+		}
+		seriesMatches = k.KuConfig.SeriesMatching.matchSeries(k.sideloadedSeries(), store)
+	}
+	var desc, series, seriesNum, subtitle *string
+	var seriesNumFloat *float64
+	n, total := 0, k.Metadata.Len()
+	unsupported := make(map[string]bool)
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		n++
+		if m.Meta == nil {
+			return true
+		}
+		desc, series, seriesNum, seriesNumFloat, subtitle = nil, nil, nil, nil, nil
+		if m.Meta.Comments != nil && *m.Meta.Comments != "" {
+			desc = m.Meta.Comments
+		}
+		if m.Meta.Series != nil && *m.Meta.Series != "" {
+			series = m.Meta.Series
+		}
+		if m.Meta.SeriesIndex != nil && *m.Meta.SeriesIndex != 0.0 {
+			sn := strconv.FormatFloat(*m.Meta.SeriesIndex, 'f', -1, 64)
+			seriesNum = &sn
+			seriesNumFloat = m.Meta.SeriesIndex
+		}
+		if field, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists && field.SubtitleColumn != "" {
+			col := field.SubtitleColumn
+			md := m.Meta
+			st := ""
+			if col == "languages" {
+				st = md.LangString()
+			} else if col == "tags" {
+				st = md.TagString()
+			} else if col == "publisher" {
+				st = md.PubString()
+			} else if col == "rating" {
+				st = md.RatingString()
+			} else if strings.HasPrefix(col, "#") {
+				if cc, exists := md.UserMetadata[col]; exists {
+					st = cc.ContextualString()
+				}
+			}
+			if st != "" {
+				subtitle = &st
+			}
+		}
+		rec := goqu.Record{
+			"Description": desc, "Series": series, "SeriesNumber": seriesNum, "SeriesNumberFloat": seriesNumFloat, "Subtitle": subtitle,
+		}
+		if useSeriesID {
+			var seriesID *string
+			if series != nil {
+				id := seriesMatches[*series].SeriesID
+				seriesID = &id
+			}
+			rec["SeriesID"] = seriesID
+		}
+		k.setOptionalFields(rec, m.Meta)
+		// Books marked as read in Calibre are marked as finished in Nickel. Only
+		// books Calibre sent this session are considered.
+		changed := k.Metadata.Changed(cid)
+		if changed && k.calibreMarkedRead(m.Meta) {
+			rec["ReadStatus"] = readStatusFinished
+			rec["___PercentRead"] = 100
+			rec["FirstTimeReading"] = "false"
+		}
+		for _, col := range caps.filterRecord("content", rec) {
+			unsupported[col] = true
+		}
+		ds := dialect.Update("content").Prepared(true).Set(rec).Where(goqu.Ex{"ContentID": cid, "ContentType": 6})
+		sqlStr, args, sqlErr := ds.ToSQL()
+		if sqlErr != nil {
+			err = fmt.Errorf("updateMetadata: failed to build query: %w", sqlErr)
+			return false
+		}
+		res := bookUpdateResult{Title: m.Meta.Title, Lpath: util.ContentIDtoLpath(cid, string(k.ContentIDprefix))}
+		if k.DryRun() {
+			// Every book is rewritten, but only those changed this session are worth reporting
+			if logSQL, _, err := ds.Prepared(false).ToSQL(); err == nil && changed {
+				k.DryRunf("would run: %s", logSQL)
+			}
+		} else if r, err := tx.Exec(sqlStr, args...); err != nil {
+			res.Err = err.Error()
+		} else if rows, _ := r.RowsAffected(); rows == 0 {
+			res.Err = "book not found in Nickel database"
+		}
+		if res.Err != "" {
+			log.Printf("updateMetadata: failed to update %s: %s", cid, res.Err)
+		}
+		// Only report on books that changed this session, unless something went wrong
+		if changed || res.Err != "" {
+			k.updateResults = append(k.updateResults, res)
+		}
+		if k.BrowserOpen && n%10 == 0 {
+			k.WebSend(WebMsg{Progress: (n * 100) / total})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for col := range unsupported {
+		log.Printf("updateMetadata: Nickel DB has no content.%s column, not updated", col)
+	}
+	if err = k.commitTx(tx, fmt.Sprintf("update the metadata of %d book(s)", total)); err != nil {
+		return fmt.Errorf("updateMetadata: failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package device
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestNickelDB creates a Nickel DB from schema, in a temporary directory
+// laid out like the root of the onboard storage. The directory is returned
+// along with the open DB, which is closed when the test finishes.
+func newTestNickelDB(t *testing.T, schema string) (string, *sql.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, koboDBpath)
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Kobo UNCaGED opens the DB read only in WAL mode, as Nickel does
+	if _, err = db.Exec(`PRAGMA journal_mode=WAL;`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	return dir, db
+}
@@ -0,0 +1,758 @@
+package device
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// pdfChunkSize is how much of a PDF is searched at a time
+const pdfChunkSize = 1 << 20
+
+// pdfMaxObjectSize limits how much is read of the Info dictionary or an XMP packet
+const pdfMaxObjectSize = 1 << 18
+
+var (
+	pdfInfoRef     = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfRootRef     = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+	pdfMetadataRef = regexp.MustCompile(`/Metadata\s+(\d+)\s+(\d+)\s+R`)
+	pdfPrevRef     = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfXrefEntry   = regexp.MustCompile(`^(\d{10}) \d{5} ([nf])`)
+	pdfDateExpr    = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?([Zz+-])?(\d{2})?'?(\d{2})?`)
+)
+
+// XMP namespaces, and the prefixes they are recorded under
+var xmpNamespaces = map[string]string{
+	"http://purl.org/dc/elements/1.1/":                    "dc",
+	"http://ns.adobe.com/xap/1.0/":                        "xmp",
+	"http://ns.adobe.com/xmp/Identifier/qual/1.0/":        "xmpidq",
+	"http://ns.adobe.com/pdf/1.3/":                        "pdf",
+	"http://calibre-ebook.com/xmp-namespace":              "calibre",
+	"http://calibre-ebook.com/xmp-namespace-series-index": "calibreSI",
+	"http://prismstandard.org/namespaces/basic/2.0/":      "prism",
+}
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// readPDFMeta reads the document information dictionary and XMP metadata of
+// a PDF. Only uncompressed objects can be read. That covers the Info
+// dictionary of most files, and XMP packets, which are usually left
+// uncompressed. Objects are found through the cross-reference table, and the
+// file is only searched when that fails. Encrypted files are skipped.
+func readPDFMeta(bkPath string, md *uc.CalibreBookMeta) error {
+	f, err := os.Open(bkPath)
+	if err != nil {
+		return fmt.Errorf("readPDFMeta: error opening pdf: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("readPDFMeta: error getting pdf size: %w", err)
+	}
+	infoOff, xmpOff, err := pdfXrefOffsets(f, fi.Size())
+	if err != nil {
+		// Files using cross-reference streams, or with a damaged
+		// cross-reference table, are searched instead
+		if infoOff, xmpOff, err = pdfScanOffsets(f, fi.Size()); err != nil {
+			return fmt.Errorf("readPDFMeta: %w", err)
+		}
+	}
+	if infoOff >= 0 {
+		obj, err := readUntil(f, infoOff, []byte("endobj"))
+		if err != nil {
+			return fmt.Errorf("readPDFMeta: error reading info dictionary: %w", err)
+		}
+		applyPDFInfo(parsePDFInfo(obj), md)
+	}
+	// XMP is preferred over the Info dictionary, so is applied last
+	if xmpOff >= 0 {
+		packet, err := readUntil(f, xmpOff, []byte("</x:xmpmeta>"))
+		if err != nil {
+			return fmt.Errorf("readPDFMeta: error reading xmp metadata: %w", err)
+		}
+		applyXMP(parseXMP(packet), md)
+	}
+	return nil
+}
+
+// pdfRef is an indirect reference to a PDF object. Object 0 is never used, so
+// the zero value means no reference.
+type pdfRef struct {
+	num, gen int
+}
+
+// pdfXrefSubsection is a run of consecutive objects in a cross-reference table
+type pdfXrefSubsection struct {
+	first, count int
+	// pos is the offset of the first entry. Entries are 20 bytes each.
+	pos int64
+}
+
+// pdfXref holds the cross-reference tables of a PDF, newest first, along with
+// what is needed from their trailers
+type pdfXref struct {
+	r          io.ReaderAt
+	sections   [][]pdfXrefSubsection
+	info, root pdfRef
+	encrypted  bool
+}
+
+// pdfXrefOffsets finds the offsets of the Info dictionary and the XMP packet
+// of the document catalog from the cross-reference tables, reading only the
+// objects needed. An offset of -1 means the file has none, or it could not be
+// read. Both are -1 for encrypted files.
+func pdfXrefOffsets(r io.ReaderAt, size int64) (infoOff, xmpOff int64, err error) {
+	x, err := readPDFXref(r, size)
+	if err != nil {
+		return -1, -1, fmt.Errorf("pdfXrefOffsets: %w", err)
+	}
+	if x.encrypted {
+		return -1, -1, nil
+	}
+	infoOff, xmpOff = -1, -1
+	if x.info.num > 0 {
+		if infoOff, _, err = x.object(x.info); err != nil {
+			return -1, -1, fmt.Errorf("pdfXrefOffsets: error getting info dictionary: %w", err)
+		}
+	}
+	_, catalog, err := x.object(x.root)
+	if err != nil {
+		return -1, -1, fmt.Errorf("pdfXrefOffsets: error getting document catalog: %w", err)
+	}
+	if ref := findPDFRef(pdfMetadataRef, catalog); ref.num > 0 {
+		off, obj, err := x.object(ref)
+		if err != nil {
+			return -1, -1, fmt.Errorf("pdfXrefOffsets: error getting xmp metadata: %w", err)
+		}
+		// A compressed metadata stream has no packet that can be found
+		if i := bytes.Index(obj, []byte("<x:xmpmeta")); i >= 0 {
+			xmpOff = off + int64(i)
+		}
+	}
+	return infoOff, xmpOff, nil
+}
+
+// readPDFXref reads the cross-reference tables of a PDF, starting at the one
+// startxref at the end of the file points to, and following the /Prev entries
+// of their trailers. Cross-reference streams are not supported.
+func readPDFXref(r io.ReaderAt, size int64) (*pdfXref, error) {
+	tailLen := int64(1024)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("readPDFXref: error reading pdf trailer: %w", err)
+	}
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return nil, fmt.Errorf("readPDFXref: startxref not found")
+	}
+	tok, _, _, err := pdfToken(r, size-tailLen+int64(i+len("startxref")))
+	if err != nil {
+		return nil, fmt.Errorf("readPDFXref: %w", err)
+	}
+	off, err := strconv.ParseInt(tok, 10, 64)
+	x := &pdfXref{r: r}
+	seen := make(map[int64]bool)
+	for err == nil && off > 0 && !seen[off] {
+		seen[off] = true
+		var subs []pdfXrefSubsection
+		var trailer []byte
+		if subs, trailer, err = readPDFXrefTable(r, off); err != nil {
+			return nil, fmt.Errorf("readPDFXref: %w", err)
+		}
+		x.sections = append(x.sections, subs)
+		// The newest trailer wins
+		if x.info.num == 0 {
+			x.info = findPDFRef(pdfInfoRef, trailer)
+		}
+		if x.root.num == 0 {
+			x.root = findPDFRef(pdfRootRef, trailer)
+		}
+		x.encrypted = x.encrypted || bytes.Contains(trailer, []byte("/Encrypt"))
+		off = -1
+		if m := pdfPrevRef.FindSubmatch(trailer); m != nil {
+			off, err = strconv.ParseInt(string(m[1]), 10, 64)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readPDFXref: bad cross-reference offset: %w", err)
+	}
+	if x.root.num == 0 {
+		return nil, fmt.Errorf("readPDFXref: no document catalog in trailer")
+	}
+	return x, nil
+}
+
+// readPDFXrefTable reads the subsections and trailer of the cross-reference
+// table at off. The entries themselves are only read when an object is looked up.
+func readPDFXrefTable(r io.ReaderAt, off int64) ([]pdfXrefSubsection, []byte, error) {
+	tok, _, pos, err := pdfToken(r, off)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readPDFXrefTable: %w", err)
+	}
+	if tok != "xref" {
+		return nil, nil, fmt.Errorf("readPDFXrefTable: no cross-reference table at %d", off)
+	}
+	var subs []pdfXrefSubsection
+	for {
+		var start int64
+		if tok, start, pos, err = pdfToken(r, pos); err != nil {
+			return nil, nil, fmt.Errorf("readPDFXrefTable: %w", err)
+		}
+		if strings.HasPrefix(tok, "trailer") {
+			trailer, err := readUntil(r, start+int64(len("trailer")), []byte("startxref"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("readPDFXrefTable: error reading trailer: %w", err)
+			}
+			return subs, trailer, nil
+		}
+		var sub pdfXrefSubsection
+		sub.first, err = strconv.Atoi(tok)
+		if err == nil {
+			if tok, _, pos, err = pdfToken(r, pos); err == nil {
+				sub.count, err = strconv.Atoi(tok)
+			}
+		}
+		if err != nil || sub.first < 0 || sub.count < 0 {
+			return nil, nil, fmt.Errorf("readPDFXrefTable: bad subsection header at %d", start)
+		}
+		if sub.count == 0 {
+			continue
+		}
+		if _, sub.pos, _, err = pdfToken(r, pos); err != nil {
+			return nil, nil, fmt.Errorf("readPDFXrefTable: %w", err)
+		}
+		// Checking the last entry catches tables that don't use 20 byte entries
+		if _, _, err = readPDFXrefEntry(r, sub.pos+int64(sub.count-1)*20); err != nil {
+			return nil, nil, fmt.Errorf("readPDFXrefTable: %w", err)
+		}
+		subs = append(subs, sub)
+		pos = sub.pos + int64(sub.count)*20
+	}
+}
+
+// readPDFXrefEntry reads the cross-reference entry at pos, returning the
+// offset of the object, and whether it is in use
+func readPDFXrefEntry(r io.ReaderAt, pos int64) (int64, bool, error) {
+	entry := make([]byte, 20)
+	if _, err := r.ReadAt(entry, pos); err != nil && err != io.EOF {
+		return 0, false, fmt.Errorf("readPDFXrefEntry: error reading entry: %w", err)
+	}
+	m := pdfXrefEntry.FindSubmatch(entry)
+	if m == nil {
+		return 0, false, fmt.Errorf("readPDFXrefEntry: bad entry at %d", pos)
+	}
+	off, _ := strconv.ParseInt(string(m[1]), 10, 64)
+	return off, m[2][0] == 'n', nil
+}
+
+// object finds the object ref in the newest cross-reference table that has it,
+// and returns its offset and contents
+func (x *pdfXref) object(ref pdfRef) (int64, []byte, error) {
+	for _, subs := range x.sections {
+		for _, sub := range subs {
+			if ref.num < sub.first || ref.num >= sub.first+sub.count {
+				continue
+			}
+			off, used, err := readPDFXrefEntry(x.r, sub.pos+int64(ref.num-sub.first)*20)
+			if err != nil {
+				return 0, nil, fmt.Errorf("object: %w", err)
+			}
+			if !used {
+				return 0, nil, fmt.Errorf("object: object %d is free", ref.num)
+			}
+			obj, err := readUntil(x.r, off, []byte("endobj"))
+			if err != nil {
+				return 0, nil, fmt.Errorf("object: error reading object %d: %w", ref.num, err)
+			}
+			// A wrong offset means the table can't be trusted
+			if !bytes.HasPrefix(bytes.TrimLeft(obj, " \t\r\n\f\x00"), []byte(fmt.Sprintf("%d %d obj", ref.num, ref.gen))) {
+				return 0, nil, fmt.Errorf("object: object %d not at offset %d", ref.num, off)
+			}
+			return off, obj, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("object: object %d not found", ref.num)
+}
+
+// findPDFRef finds the reference matched by re, such as pdfInfoRef, in dict
+func findPDFRef(re *regexp.Regexp, dict []byte) pdfRef {
+	var ref pdfRef
+	if m := re.FindSubmatch(dict); m != nil {
+		ref.num, _ = strconv.Atoi(string(m[1]))
+		ref.gen, _ = strconv.Atoi(string(m[2]))
+	}
+	return ref
+}
+
+// pdfToken reads the token at or after pos, skipping whitespace. The offsets
+// of its start and end are returned with it.
+func pdfToken(r io.ReaderAt, pos int64) (string, int64, int64, error) {
+	buf := make([]byte, 32)
+	for {
+		n, err := r.ReadAt(buf, pos)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", 0, 0, fmt.Errorf("pdfToken: error reading file: %w", err)
+		}
+		b := buf[:n]
+		i := 0
+		for i < len(b) && isPDFSpace(b[i]) {
+			i++
+		}
+		if i == len(b) {
+			pos += int64(n)
+			continue
+		}
+		j := i
+		for j < len(b) && !isPDFSpace(b[j]) {
+			j++
+		}
+		if j == len(b) && n == len(buf) && i > 0 {
+			// The token may carry on past buf, so read again from its start
+			pos += int64(i)
+			continue
+		}
+		return string(b[i:j]), pos + int64(i), pos + int64(j), nil
+	}
+}
+
+// isPDFSpace tests for the white-space characters of the PDF syntax
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+// pdfScanOffsets searches the whole file for the last Info dictionary the
+// trailer refers to and the last XMP packet, returning their offsets, or -1
+// if not found. Both are -1 for encrypted files.
+func pdfScanOffsets(r io.ReaderAt, size int64) (infoOff, xmpOff int64, err error) {
+	// The trailer (or xref stream dictionary) at the end of the file refers to the Info object
+	tailLen := int64(pdfChunkSize)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err = r.ReadAt(tail, size-tailLen); err != nil && err != io.EOF {
+		return -1, -1, fmt.Errorf("pdfScanOffsets: error reading pdf trailer: %w", err)
+	}
+	if bytes.Contains(tail, []byte("/Encrypt")) {
+		return -1, -1, nil
+	}
+	patterns := [][]byte{[]byte("<x:xmpmeta")}
+	if refs := pdfInfoRef.FindAllSubmatch(tail, -1); len(refs) > 0 {
+		ref := refs[len(refs)-1]
+		patterns = append(patterns, []byte(fmt.Sprintf("%s %s obj", ref[1], ref[2])))
+	}
+	offsets, err := lastOffsets(r, size, patterns)
+	if err != nil {
+		return -1, -1, fmt.Errorf("pdfScanOffsets: %w", err)
+	}
+	infoOff = -1
+	if len(offsets) > 1 {
+		infoOff = offsets[1]
+	}
+	return infoOff, offsets[0], nil
+}
+
+// lastOffsets searches r for each pattern, and returns the offset of its last
+// occurrence, or -1 if not found. A match must not directly follow a digit, so
+// that "1 0 obj" does not match "11 0 obj". Incremental updates append newer
+// objects, which is why the last occurrence is wanted.
+func lastOffsets(r io.ReaderAt, size int64, patterns [][]byte) ([]int64, error) {
+	offsets := make([]int64, len(patterns))
+	overlap := 0
+	for i := range offsets {
+		offsets[i] = -1
+		if len(patterns[i]) > overlap {
+			overlap = len(patterns[i])
+		}
+	}
+	buf := make([]byte, pdfChunkSize+overlap)
+	for pos := int64(0); pos < size; pos += pdfChunkSize {
+		n, err := r.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("lastOffsets: error reading file: %w", err)
+		}
+		chunk := buf[:n]
+		for i, p := range patterns {
+			for start := 0; ; {
+				j := bytes.Index(chunk[start:], p)
+				if j < 0 {
+					break
+				}
+				at := start + j
+				if at >= pdfChunkSize {
+					// Found again at the start of the next chunk
+					break
+				}
+				prev := byte(' ')
+				if at > 0 {
+					prev = chunk[at-1]
+				} else if pos > 0 {
+					var b [1]byte
+					if _, err = r.ReadAt(b[:], pos-1); err == nil {
+						prev = b[0]
+					}
+				}
+				if prev < '0' || prev > '9' {
+					offsets[i] = pos + int64(at)
+				}
+				start = at + 1
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// readUntil reads from off until the end marker, up to pdfMaxObjectSize bytes
+func readUntil(r io.ReaderAt, off int64, end []byte) ([]byte, error) {
+	buf := make([]byte, pdfMaxObjectSize)
+	n, err := r.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	if i := bytes.Index(buf, end); i >= 0 {
+		return buf[:i+len(end)], nil
+	}
+	return nil, fmt.Errorf("end of object not found")
+}
+
+// parsePDFInfo gets the string values of a PDF Info dictionary object
+func parsePDFInfo(obj []byte) map[string]string {
+	info := make(map[string]string)
+	start := bytes.Index(obj, []byte("<<"))
+	if start < 0 {
+		return info
+	}
+	p := obj[start+2:]
+	for len(p) > 0 {
+		p = bytes.TrimLeft(p, " \t\r\n\f\x00")
+		if len(p) == 0 || bytes.HasPrefix(p, []byte(">>")) {
+			break
+		}
+		if p[0] != '/' {
+			// Not a dictionary we understand
+			break
+		}
+		keyEnd := bytes.IndexAny(p[1:], " \t\r\n\f/([<")
+		if keyEnd < 0 {
+			break
+		}
+		key := string(p[1 : keyEnd+1])
+		p = bytes.TrimLeft(p[keyEnd+1:], " \t\r\n\f\x00")
+		var val string
+		var ok bool
+		val, p, ok = pdfValue(p)
+		if !ok {
+			break
+		}
+		if val != "" {
+			info[key] = val
+		}
+	}
+	return info
+}
+
+// pdfValue parses a single value from a dictionary. Only strings are
+// decoded, other values are skipped.
+func pdfValue(p []byte) (val string, rest []byte, ok bool) {
+	if len(p) == 0 {
+		return "", p, false
+	}
+	switch {
+	case p[0] == '(':
+		return pdfLiteralString(p)
+	case bytes.HasPrefix(p, []byte("<<")):
+		// Nested dictionaries don't hold anything of interest
+		depth := 0
+		for i := 0; i+1 < len(p); i++ {
+			if p[i] == '<' && p[i+1] == '<' {
+				depth++
+				i++
+			} else if p[i] == '>' && p[i+1] == '>' {
+				depth--
+				i++
+				if depth == 0 {
+					return "", p[i+1:], true
+				}
+			}
+		}
+		return "", nil, false
+	case p[0] == '<':
+		end := bytes.IndexByte(p, '>')
+		if end < 0 {
+			return "", nil, false
+		}
+		hex := bytes.Map(func(r rune) rune {
+			if strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return r
+			}
+			return -1
+		}, p[1:end])
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+		b := make([]byte, len(hex)/2)
+		for i := range b {
+			v, _ := strconv.ParseUint(string(hex[i*2:i*2+2]), 16, 8)
+			b[i] = byte(v)
+		}
+		return pdfTextString(b), p[end+1:], true
+	default:
+		// Names, numbers, references and the like. Skip to the next key.
+		end := bytes.IndexByte(p[1:], '/')
+		if end < 0 {
+			return "", nil, true
+		}
+		return "", p[end+1:], true
+	}
+}
+
+// pdfLiteralString decodes a PDF literal string, including escapes and nested parentheses
+func pdfLiteralString(p []byte) (string, []byte, bool) {
+	var b []byte
+	depth := 0
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfTextString(b), p[i+1:], true
+			}
+		case '\\':
+			i++
+			if i >= len(p) {
+				return "", nil, false
+			}
+			switch e := p[i]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// A line continuation
+				if e == '\r' && i+1 < len(p) && p[i+1] == '\n' {
+					i++
+				}
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for j := 0; j < 3 && i < len(p) && p[i] >= '0' && p[i] <= '7'; j++ {
+						v = v*8 + int(p[i]-'0')
+						i++
+					}
+					i--
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return "", nil, false
+}
+
+// pdfTextString decodes a PDF text string, which is either UTF-16BE with a
+// byte order mark, or PDFDocEncoding. The latter is treated as Latin-1, which
+// it matches for all printable characters most documents use.
+func pdfTextString(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		return strings.TrimSpace(string(b[3:]))
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+// parsePDFDate parses a PDF date string, of the form D:YYYYMMDDHHmmSSOHH'mm'
+func parsePDFDate(s string) *uc.CalibreTime {
+	m := pdfDateExpr.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil
+	}
+	num := func(s string, def int) int {
+		if v, err := strconv.Atoi(s); err == nil {
+			return v
+		}
+		return def
+	}
+	loc := time.UTC
+	if m[7] == "+" || m[7] == "-" {
+		offset := num(m[8], 0)*3600 + num(m[9], 0)*60
+		if m[7] == "-" {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	t := time.Date(num(m[1], 0), time.Month(num(m[2], 1)), num(m[3], 1), num(m[4], 0), num(m[5], 0), num(m[6], 0), 0, loc)
+	ct := uc.ConvertTime(t.UTC())
+	return &ct
+}
+
+// applyPDFInfo fills book metadata from the PDF Info dictionary
+func applyPDFInfo(info map[string]string, md *uc.CalibreBookMeta) {
+	if t := info["Title"]; t != "" {
+		md.Title = t
+	}
+	if a := splitNames(info["Author"], ";&"); len(a) > 0 {
+		md.Authors = a
+	}
+	if s := info["Subject"]; s != "" {
+		md.Comments = &s
+	}
+	if kw := splitNames(info["Keywords"], ",;"); len(kw) > 0 {
+		md.Tags = kw
+	}
+	if d := parsePDFDate(info["CreationDate"]); d != nil {
+		md.Pubdate = d
+	}
+}
+
+// parseXMP collects the values of the XMP properties in a packet, keyed by
+// "prefix:name". Values of list properties (rdf:Seq, rdf:Bag, rdf:Alt) are
+// returned in order.
+func parseXMP(packet []byte) map[string][]string {
+	props := make(map[string][]string)
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	dec.Strict = false
+	var stack []string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := ""
+			if t.Name.Space != rdfNamespace {
+				if prefix, ok := xmpNamespaces[t.Name.Space]; ok {
+					name = prefix + ":" + t.Name.Local
+				} else {
+					name = "?"
+				}
+			}
+			stack = append(stack, name)
+			// Simple properties may be written as attributes, and identifier
+			// schemes as a qualifier attribute
+			for _, a := range t.Attr {
+				if prefix, ok := xmpNamespaces[a.Name.Space]; ok {
+					key := prefix + ":" + a.Name.Local
+					props[key] = append(props[key], strings.TrimSpace(a.Value))
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			val := strings.TrimSpace(string(t))
+			if val == "" {
+				continue
+			}
+			// The property is the nearest element that isn't RDF syntax
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] != "" {
+					if stack[i] != "?" {
+						props[stack[i]] = append(props[stack[i]], val)
+					}
+					break
+				}
+			}
+		}
+	}
+	return props
+}
+
+// applyXMP fills book metadata from XMP properties, including those Calibre writes
+func applyXMP(props map[string][]string, md *uc.CalibreBookMeta) {
+	first := func(key string) string {
+		if v := props[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	if t := first("dc:title"); t != "" {
+		md.Title = t
+	}
+	if a := props["dc:creator"]; len(a) > 0 {
+		md.Authors = a
+	}
+	if d := first("dc:description"); d != "" {
+		md.Comments = &d
+	}
+	if p := first("dc:publisher"); p != "" {
+		md.Publisher = &p
+	}
+	if s := props["dc:subject"]; len(s) > 0 {
+		md.Tags = s
+	}
+	if l := props["dc:language"]; len(l) > 0 {
+		md.Languages = l
+	}
+	if d := parseLooseTime(first("dc:date")); d != nil {
+		md.Pubdate = d
+	}
+	if s := first("calibre:series"); s != "" {
+		md.Series = &s
+		if index, err := strconv.ParseFloat(first("calibreSI:series_index"), 64); err == nil {
+			md.SeriesIndex = &index
+		}
+	}
+	if ts := parseLooseTime(first("calibre:timestamp")); ts != nil {
+		md.Timestamp = ts
+	}
+	if ts := first("calibre:title_sort"); ts != "" {
+		md.TitleSort = ts
+	}
+	// Identifiers are pairs of a scheme qualifier and a value
+	schemes, ids := props["xmpidq:Scheme"], props["xmp:Identifier"]
+	for i := 0; i < len(schemes) && i < len(ids); i++ {
+		setIdentifier(md, schemes[i], ids[i])
+	}
+	for _, id := range props["dc:identifier"] {
+		// eg: "urn:isbn:9780553380163" as well as "isbn:9780553380163"
+		if len(id) > 4 && strings.EqualFold(id[:4], "urn:") {
+			id = id[4:]
+		}
+		if scheme, value, found := strings.Cut(id, ":"); found {
+			setIdentifier(md, scheme, value)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package device
+
+import (
+	"time"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// Nickel ReadStatus values
+const (
+	readStatusUnread   = 0
+	readStatusReading  = 1
+	readStatusFinished = 2
+)
+
+// Nickel hasn't been consistent with its timestamp formats over the years
+var nickelTimeLayouts = []string{
+	nickelTimeFormat,
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.000-07:00",
+	"2006-01-02 15:04:05-07:00",
+	time.RFC3339,
+}
+
+// parseNickelTime parses a timestamp from the Nickel DB. nil is returned if
+// the timestamp is empty or could not be parsed.
+func parseNickelTime(ts *string) *time.Time {
+	if ts == nil || *ts == "" {
+		return nil
+	}
+	for _, layout := range nickelTimeLayouts {
+		if t, err := time.Parse(layout, *ts); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// customColumn creates a custom column for col, ready to have its value set.
+// The column definition is taken from the book if it has one, otherwise from
+// the library field metadata. ok is false if the column is unknown.
+func (k *Kobo) customColumn(md *uc.CalibreBookMeta, col string) (cc uc.CalibreCustomColumn, ok bool) {
+	if cc, ok = md.UserMetadata[col]; ok {
+		return cc, true
+	}
+	field, ok := k.LibInfo.FieldMetadata[col]
+	if !ok || !field.IsCustom {
+		return cc, false
+	}
+	cc.ColNum, cc.RecIndex, cc.Label, cc.Datatype = field.ColNum, field.RecIndex, field.Label, field.Datatype
+	cc.Name, cc.CategorySort, cc.IsCsp, cc.Kind = field.Name, field.CategorySort, field.IsCsp, field.Kind
+	cc.IsCustom, cc.IsEditable, cc.Column, cc.SearchTerms = field.IsCustom, field.IsEditable, field.Column, field.SearchTerms
+	cc.IsCategory, cc.Table, cc.Display, cc.LinkColumn = field.IsCategory, field.Table, field.Display, field.LinkColumn
+	return cc, true
+}
+
+// copyUserMetadata replaces the user metadata map of md with a copy, so that
+// values set on it don't end up in the metadata cache.
+func copyUserMetadata(md *uc.CalibreBookMeta) {
+	userMeta := make(map[string]uc.CalibreCustomColumn, len(md.UserMetadata)+4)
+	for col, cc := range md.UserMetadata {
+		userMeta[col] = cc
+	}
+	md.UserMetadata = userMeta
+}
+
+// setReadingColumns adds the Nickel reading state of a book to the custom
+// columns the user has mapped them to.
+func (k *Kobo) setReadingColumns(md *uc.CalibreBookMeta, rs *readingState) {
+	libOpts, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]
+	if rs == nil || !exists {
+		return
+	}
+	if libOpts.ReadStatusColumn == "" && libOpts.PercentReadColumn == "" &&
+		libOpts.LastReadColumn == "" && libOpts.TimeSpentColumn == "" {
+		return
+	}
+	copyUserMetadata(md)
+	set := func(col string, val func(dt uc.CalibreColumnDataType) interface{}) {
+		if col == "" {
+			return
+		}
+		cc, ok := k.customColumn(md, col)
+		if !ok {
+			return
+		}
+		if v := val(cc.Datatype); v != nil {
+			cc.Value = v
+			md.UserMetadata[col] = cc
+		}
+	}
+	// Note, numeric values are float64's, as they would be if decoded from Calibre's JSON
+	set(libOpts.ReadStatusColumn, func(dt uc.CalibreColumnDataType) interface{} {
+		switch dt {
+		case "bool":
+			return rs.readStatus == readStatusFinished
+		case "int":
+			return float64(rs.readStatus)
+		}
+		return nil
+	})
+	set(libOpts.PercentReadColumn, func(dt uc.CalibreColumnDataType) interface{} {
+		switch dt {
+		case "int", "float":
+			if rs.readStatus == readStatusFinished {
+				return float64(100)
+			}
+			return float64(rs.percentRead)
+		}
+		return nil
+	})
+	set(libOpts.LastReadColumn, func(dt uc.CalibreColumnDataType) interface{} {
+		if dt == "datetime" && rs.lastRead != nil && rs.readStatus != readStatusUnread {
+			return string(uc.ConvertTime(rs.lastRead.UTC()))
+		}
+		return nil
+	})
+	// Nickel records time spent reading in seconds. Minutes are rather more useful
+	set(libOpts.TimeSpentColumn, func(dt uc.CalibreColumnDataType) interface{} {
+		switch dt {
+		case "int", "float":
+			return float64(rs.timeSpent / 60)
+		}
+		return nil
+	})
+}
+
+// calibreMarkedRead tests whether the book has been marked as read in Calibre,
+// using the column the user has selected.
+func (k *Kobo) calibreMarkedRead(md *uc.CalibreBookMeta) bool {
+	libOpts, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]
+	if !exists || libOpts.MarkReadColumn == "" {
+		return false
+	}
+	if cc, exists := md.UserMetadata[libOpts.MarkReadColumn]; exists {
+		if read, ok := cc.Value.(bool); ok {
+			return read
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package device
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Books are received into a file with this suffix next to the book, which
+// Nickel does not import
+const partialBookSuffix = ".kupart"
+
+// ReceiveBook writes a book sent by Calibre to bkPath. The book is received
+// into a temporary file, which only replaces bkPath once it has been received
+// in full and verified, so an interrupted transfer never replaces a good copy.
+// The hex encoded SHA-256 digest of the book is returned.
+func (k *Kobo) ReceiveBook(bkPath string, book io.Reader, length int) (string, error) {
+	h := sha256.New()
+	if k.DryRun() {
+		k.DryRunf("would save %s (%d bytes)", bkPath, length)
+		// The book still has to be read, so the connection to Calibre is left in a sane state
+		if _, err := io.CopyN(h, book, int64(length)); err != nil {
+			return "", fmt.Errorf("ReceiveBook: error reading ebook: %w", err)
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(bkPath), 0777); err != nil {
+		return "", fmt.Errorf("ReceiveBook: error making book directories: %w", err)
+	}
+	tmpPath := bkPath + partialBookSuffix
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", fmt.Errorf("ReceiveBook: error opening ebook file: %w", err)
+	}
+	n, err := io.CopyN(io.MultiWriter(f, h), book, int64(length))
+	if err == io.EOF {
+		err = fmt.Errorf("transfer ended after %d of %d bytes", n, length)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyBook(tmpPath, filepath.Ext(bkPath), int64(length))
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, bkPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("ReceiveBook: error receiving %s: %w", filepath.Base(bkPath), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyBook checks that the book at bkPath is size bytes long, and that
+// zip based formats (by ext) have an intact central directory, which is the
+// first thing lost when a transfer is cut short
+func verifyBook(bkPath, ext string, size int64) error {
+	fi, err := os.Stat(bkPath)
+	if err != nil {
+		return fmt.Errorf("verifyBook: %w", err)
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("verifyBook: file is %d bytes, expected %d", fi.Size(), size)
+	}
+	switch strings.ToLower(ext) {
+	case ".epub", ".kepub", ".cbz":
+		zr, err := zip.OpenReader(bkPath)
+		if err != nil {
+			return fmt.Errorf("verifyBook: invalid zip file: %w", err)
+		}
+		defer zr.Close()
+		if len(zr.File) == 0 {
+			return fmt.Errorf("verifyBook: zip file is empty")
+		}
+	}
+	return nil
+}
+
+// removePartialBooks removes books left behind by transfers that were
+// interrupted by Kobo UNCaGED exiting
+func (k *Kobo) removePartialBooks() error {
+	err := k.walkBookRoot(func(p, lpath string) {
+		if !strings.HasSuffix(p, partialBookSuffix) {
+			return
+		} else if k.DryRun() {
+			k.DryRunf("would remove incomplete transfer %s", lpath)
+			return
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("removePartialBooks: %v", err)
+			return
+		}
+		log.Printf("removePartialBooks: removed incomplete transfer %s", lpath)
+	})
+	if err != nil {
+		return fmt.Errorf("removePartialBooks: %w", err)
+	}
+	return nil
+}
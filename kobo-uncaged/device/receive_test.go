@@ -0,0 +1,80 @@
+package device
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestReceiveBook(t *testing.T) {
+	dir := t.TempDir()
+	k := &Kobo{BKRootDir: dir}
+	var epub bytes.Buffer
+	zw := zip.NewWriter(&epub)
+	w, _ := zw.Create("mimetype")
+	w.Write([]byte("application/epub+zip"))
+	zw.Close()
+	bkPath := filepath.Join(dir, "Author", "Book.epub")
+
+	digest, err := k.ReceiveBook(bkPath, bytes.NewReader(epub.Bytes()), epub.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(epub.Bytes()); digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest = %s, want %x", digest, sum)
+	}
+	// A transfer cut short, and a corrupt book, must leave the previous copy in place
+	if _, err := k.ReceiveBook(bkPath, bytes.NewReader(epub.Bytes()[:epub.Len()/2]), epub.Len()); err == nil {
+		t.Errorf("truncated transfer did not fail")
+	}
+	corrupt := bytes.Repeat([]byte{'x'}, epub.Len())
+	if _, err := k.ReceiveBook(bkPath, bytes.NewReader(corrupt), len(corrupt)); err == nil {
+		t.Errorf("corrupt epub was not rejected")
+	}
+	if data, _ := os.ReadFile(bkPath); !bytes.Equal(data, epub.Bytes()) {
+		t.Errorf("previous copy of the book was replaced")
+	}
+	if _, err := os.Stat(bkPath + partialBookSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind after a failed transfer")
+	}
+
+	// Partial files from a previous session are removed at startup
+	os.WriteFile(bkPath+partialBookSuffix, []byte("partial"), 0644)
+	if err := k.removePartialBooks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bkPath + partialBookSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file not removed")
+	}
+	if _, err := os.Stat(bkPath); err != nil {
+		t.Errorf("book removed along with the partial file: %v", err)
+	}
+}
+
+func TestUpdateIfExists(t *testing.T) {
+	k := &Kobo{Metadata: NewMetadataStore(2), replacedBooks: make(map[string]int)}
+	k.Metadata.set("a", BookMeta{Meta: &uc.CalibreBookMeta{Size: 10}, sha256: "aaaa"})
+	k.Metadata.set("b", BookMeta{Meta: &uc.CalibreBookMeta{Size: 10}})
+
+	k.UpdateIfExists("a", 10, "aaaa")
+	k.UpdateIfExists("b", 10, "bbbb")
+	if len(k.replacedBooks) != 0 {
+		t.Errorf("unchanged books queued for replacement: %v", k.replacedBooks)
+	}
+	// A book edited in Calibre can keep its size
+	k.UpdateIfExists("a", 10, "cccc")
+	// and has to be given a different size for Nickel to re-import it
+	if size, exists := k.replacedBooks["a"]; !exists || size == 10 {
+		t.Errorf("book with a new digest queued with size %d, %v, want a size other than 10", size, exists)
+	}
+	k.UpdateIfExists("b", 12, "")
+	if size := k.replacedBooks["b"]; size != 12 {
+		t.Errorf("resized book queued with size %d, want 12", size)
+	}
+}
@@ -0,0 +1,206 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// Ways the book files, Nickel DB and metadata cache can disagree
+const (
+	// pendingBook is a book file Nickel has not imported yet
+	pendingBook = "pending"
+	// missingFile is a book in the Nickel DB whose file has been deleted
+	missingFile = "missingFile"
+	// staleRecord is a metadata.calibre record with neither a file nor a DB entry
+	staleRecord = "staleRecord"
+)
+
+// reconcileEntry is a book found by ReconcileBooks
+type reconcileEntry struct {
+	Lpath  string `json:"lpath"`
+	Title  string `json:"title"`
+	Kind   string `json:"kind"`
+	Listed bool   `json:"listed"`
+	Pruned bool   `json:"pruned"`
+}
+
+// ReconcileBooks compares the book files on disk with the Nickel DB and
+// the metadata cache. Depending on the user's options, pending books are
+// added to the metadata cache, so Calibre sees them, and entries for deleted
+// books are pruned. Nickel removes the DB rows of deleted books itself, on
+// the library rescan at the end of the session. Walking the book root is slow
+// on large libraries, so it is only done once per session, and the result kept.
+func (k *Kobo) ReconcileBooks() ([]reconcileEntry, error) {
+	if k.reconciled != nil {
+		return k.reconciled, nil
+	}
+	onDisk, err := k.bookFilesOnDisk()
+	if err != nil {
+		return nil, fmt.Errorf("ReconcileBooks: %w", err)
+	}
+	entries := make([]reconcileEntry, 0)
+	var deleted []string
+	for cid := range onDisk {
+		if _, exists := k.Metadata.Get(cid); exists {
+			continue
+		}
+		lpath := util.ContentIDtoLpath(cid, string(k.ContentIDprefix))
+		e := reconcileEntry{Lpath: lpath, Kind: pendingBook}
+		var md *uc.CalibreBookMeta
+		var digest string
+		if raw, exists := k.unmatchedMD[lpath]; exists {
+			rec, err := decodeMDrecord(raw)
+			if err != nil {
+				return nil, fmt.Errorf("ReconcileBooks: %s: %w", lpath, err)
+			}
+			md, digest = rec.CalibreBookMeta, rec.SHA256
+		}
+		if k.KuConfig.ListPendingBooks {
+			if md != nil {
+				// Calibre's metadata is written to the DB once Nickel imports the book
+				k.Metadata.Put(cid, md)
+				k.Metadata.SetSHA256(cid, digest)
+				delete(k.unmatchedMD, lpath)
+			} else {
+				md = k.buildBookMeta(cid, dbBookMeta{})
+				k.Metadata.set(cid, BookMeta{Meta: md})
+			}
+			e.Listed = true
+		}
+		if md != nil {
+			e.Title = md.Title
+		}
+		entries = append(entries, e)
+	}
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		if onDisk[cid] {
+			return true
+		}
+		e := reconcileEntry{Lpath: util.ContentIDtoLpath(cid, string(k.ContentIDprefix)), Kind: missingFile}
+		if m.Meta != nil {
+			e.Title = m.Meta.Title
+		}
+		if k.KuConfig.PruneMissingBooks {
+			k.Metadata.Delete(cid)
+			deleted = append(deleted, e.Lpath)
+			e.Pruned = true
+		}
+		entries = append(entries, e)
+		return true
+	})
+	for lpath, raw := range k.unmatchedMD {
+		if onDisk[util.LpathToContentID(lpath, string(k.ContentIDprefix))] {
+			continue
+		}
+		e := reconcileEntry{Lpath: lpath, Kind: staleRecord}
+		var md uc.CalibreBookMeta
+		if json.Unmarshal(raw, &md) == nil {
+			e.Title = md.Title
+		}
+		if k.KuConfig.PruneMissingBooks {
+			delete(k.unmatchedMD, lpath)
+			deleted = append(deleted, lpath)
+			e.Pruned = true
+		}
+		entries = append(entries, e)
+	}
+	for _, lpath := range deleted {
+		if err = k.RecordDeletion(lpath); err != nil {
+			return entries, fmt.Errorf("ReconcileBooks: %w", err)
+		}
+	}
+	k.reconciled = entries
+	k.warnReconciled()
+	return entries, nil
+}
+
+// bookFilesOnDisk finds the sideloaded books on disk, and returns their
+// ContentID's. Hidden directories, which hold store books and Nickel's (and
+// our) own files, are skipped.
+func (k *Kobo) bookFilesOnDisk() (map[string]bool, error) {
+	onDisk := make(map[string]bool)
+	err := k.walkBookRoot(func(p, lpath string) {
+		if isSupportedBook(lpath) {
+			onDisk[util.LpathToContentID(lpath, string(k.ContentIDprefix))] = true
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bookFilesOnDisk: %w", err)
+	}
+	return onDisk, nil
+}
+
+// walkBookRoot calls fn with the path and lpath of every file under the book
+// root. Hidden files and directories are skipped.
+func (k *Kobo) walkBookRoot(fn func(p, lpath string)) error {
+	root := filepath.Clean(k.BKRootDir)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped, rather than failing the whole walk
+			log.Printf("walkBookRoot: %v", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != root {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(root, p); err == nil {
+			fn(p, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walkBookRoot: error walking %s: %w", root, err)
+	}
+	return nil
+}
+
+// isSupportedBook tests whether a file name has the extension of a supported format
+func isSupportedBook(name string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	for _, f := range supportedFormats {
+		if ext == f {
+			return true
+		}
+	}
+	return false
+}
+
+// warnReconciled tells the user what ReconcileBooks found
+func (k *Kobo) warnReconciled() {
+	counts := make(map[string]int)
+	for _, e := range k.reconciled {
+		counts[e.Kind]++
+	}
+	var warnings []string
+	if n := counts[pendingBook]; n > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d book(s) have not been imported by the Kobo yet.", n))
+	}
+	if n := counts[missingFile]; n > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d book(s) in the Kobo library have no book file.", n))
+	}
+	if n := counts[staleRecord]; n > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d metadata.calibre record(s) have neither a book file nor a library entry.", n))
+	}
+	for _, warning := range warnings {
+		log.Println(warning)
+		if k.BrowserOpen {
+			k.WebSend(WebMsg{Warning: warning + " See the list when the session finishes.", Progress: IgnoreProgress})
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package device
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestReconcileBooks(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{"a.epub", "pending/b.kepub.epub", "c.pdf", "notes.jpg", ".kobo/kepub/store"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, fn)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k := &Kobo{
+		DBRootDir:       dir,
+		BKRootDir:       dir,
+		ContentIDprefix: onboardPrefix,
+		KuConfig:        &KuOptions{ListPendingBooks: true, PruneMissingBooks: true},
+		Metadata:        NewMetadataStore(0),
+		unmatchedMD: map[string]json.RawMessage{
+			"pending/b.kepub.epub": json.RawMessage(`{"lpath":"pending/b.kepub.epub","title":"B"}`),
+			"e.epub":               json.RawMessage(`{"lpath":"e.epub","title":"E"}`),
+		},
+	}
+	k.Metadata.set(string(onboardPrefix)+"a.epub", BookMeta{Meta: &uc.CalibreBookMeta{Lpath: "a.epub", Title: "A"}})
+	k.Metadata.set(string(onboardPrefix)+"d.epub", BookMeta{Meta: &uc.CalibreBookMeta{Lpath: "d.epub", Title: "D"}})
+
+	entries, err := k.ReconcileBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"pending/b.kepub.epub": pendingBook, "c.pdf": pendingBook, "d.epub": missingFile, "e.epub": staleRecord}
+	if len(entries) != len(want) {
+		t.Errorf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for _, e := range entries {
+		if want[e.Lpath] != e.Kind {
+			t.Errorf("%s classified as %q, want %q", e.Lpath, e.Kind, want[e.Lpath])
+		}
+	}
+	if m, ok := k.Metadata.Get(string(onboardPrefix) + "pending/b.kepub.epub"); !ok || m.Meta.Title != "B" || !k.Metadata.IsNew(string(onboardPrefix)+"pending/b.kepub.epub") {
+		t.Errorf("pending book with a metadata.calibre record not listed as new")
+	}
+	if m, ok := k.Metadata.Get(string(onboardPrefix) + "c.pdf"); !ok || m.Meta.UUID == "" || k.Metadata.Changed(string(onboardPrefix)+"c.pdf") {
+		t.Errorf("pending book without a record not listed unchanged")
+	}
+	if _, ok := k.Metadata.Get(string(onboardPrefix) + "d.epub"); ok {
+		t.Errorf("book with a missing file not pruned")
+	}
+	if len(k.unmatchedMD) != 0 {
+		t.Errorf("unmatched records left: %v", k.unmatchedMD)
+	}
+	// The book root is only walked once per session
+	os.WriteFile(filepath.Join(dir, "f.epub"), []byte("x"), 0644)
+	if again, err := k.ReconcileBooks(); err != nil || len(again) != len(entries) {
+		t.Errorf("second ReconcileBooks() = %d entries, %v, want the %d found before", len(again), err, len(entries))
+	}
+}
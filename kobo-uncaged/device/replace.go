@@ -0,0 +1,303 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/kapmahc/epub"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+)
+
+// chapterIDcolumns are the columns of the Nickel DB that refer to a chapter
+// of a book by ContentID. Columns missing from the DB are skipped.
+// content.ChapterIDBookmarked holds a path relative to the book instead, and
+// is remapped separately.
+var chapterIDcolumns = []struct{ table, col string }{
+	{"content", "ContentID"},
+	{"Bookmark", "ContentID"},
+	{"volume_shortcovers", "shortcoverId"},
+}
+
+// chapterRemap describes how the chapters of a replaced kepub changed
+type chapterRemap struct {
+	oldSpine []string
+	moved    map[string]string
+	removed  []string
+}
+
+// orphanedAnnotation is an annotation that could not be reattached to a
+// replaced book, as its chapter is no longer in the book
+type orphanedAnnotation struct {
+	Lpath   string `json:"lpath"`
+	Chapter string `json:"chapter"`
+	Text    string `json:"text"`
+}
+
+// BookSpine gets the chapters of a kepub already on the device, so they can
+// be compared with those of a new copy. Nil is returned for other books.
+func (k *Kobo) BookSpine(cid string) []string {
+	if _, exists := k.Metadata.Get(cid); !exists || k.DryRun() || !strings.HasSuffix(strings.ToLower(cid), ".kepub.epub") {
+		return nil
+	}
+	spine, err := readSpine(util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix)))
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return spine
+}
+
+// QueueChapterRemap compares oldSpine with the chapters of the new copy of a
+// replaced book. Chapters that moved or were removed are fixed in the Nickel
+// DB along with the filesize of the book.
+func (k *Kobo) QueueChapterRemap(cid string, oldSpine []string) {
+	if _, replaced := k.replacedBooks[cid]; !replaced || oldSpine == nil {
+		return
+	}
+	newSpine, err := readSpine(util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix)))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	moved, removed := matchSpines(oldSpine, newSpine)
+	if len(moved) > 0 || len(removed) > 0 {
+		k.chapterRemaps[cid] = chapterRemap{oldSpine: oldSpine, moved: moved, removed: removed}
+	}
+}
+
+// OrphanedAnnotations returns the number of annotations that could not be
+// reattached to replaced books
+func (k *Kobo) OrphanedAnnotations() int {
+	return len(k.orphaned)
+}
+
+// readSpine reads the paths, relative to the OPF file, of the chapters in the
+// spine of the epub at bkPath
+func readSpine(bkPath string) ([]string, error) {
+	bk, err := epub.Open(bkPath)
+	if err != nil {
+		return nil, fmt.Errorf("readSpine: error opening epub: %w", err)
+	}
+	defer bk.Close()
+	hrefs := make(map[string]string, len(bk.Opf.Manifest))
+	for _, item := range bk.Opf.Manifest {
+		hrefs[item.ID] = path.Clean(item.Href)
+	}
+	spine := make([]string, 0, len(bk.Opf.Spine.Items))
+	for _, item := range bk.Opf.Spine.Items {
+		if href, exists := hrefs[item.IDref]; exists {
+			spine = append(spine, href)
+		}
+	}
+	return spine, nil
+}
+
+// matchSpines matches the chapters of the old copy of a book to those of the
+// new copy. Chapters are matched by path, then by file name. The rest are only
+// matched by their order in the spine if every chapter was renamed and the
+// number of chapters is the same, or if the chapters either side of them
+// line up in both copies. Anything else is reported as removed, as a chapter
+// that was removed and one that was added are not the same chapter.
+// Only chapters whose path changed are in moved.
+func matchSpines(oldSpine, newSpine []string) (moved map[string]string, removed []string) {
+	moved = make(map[string]string)
+	inOld, inNew := make(map[string]bool), make(map[string]bool)
+	for _, p := range oldSpine {
+		inOld[p] = true
+	}
+	for _, p := range newSpine {
+		inNew[p] = true
+	}
+	// matched maps each old chapter that was found in the new copy to its path there
+	matched := make(map[string]string)
+	oldNames, newNames := make(map[string]int), make(map[string]int)
+	newByName := make(map[string]string)
+	for _, p := range oldSpine {
+		if inNew[p] {
+			matched[p] = p
+		} else {
+			oldNames[path.Base(p)]++
+		}
+	}
+	for _, p := range newSpine {
+		if !inOld[p] {
+			newNames[path.Base(p)]++
+			newByName[path.Base(p)] = p
+		}
+	}
+	for _, p := range oldSpine {
+		if name := path.Base(p); !inNew[p] && oldNames[name] == 1 && newNames[name] == 1 {
+			matched[p] = newByName[name]
+		}
+	}
+	used := make(map[string]bool, len(matched))
+	for _, n := range matched {
+		used[n] = true
+	}
+	if len(matched) == 0 && len(oldSpine) == len(newSpine) {
+		for i, p := range oldSpine {
+			moved[p] = newSpine[i]
+		}
+		return moved, nil
+	}
+	newIndex := make(map[string]int, len(newSpine))
+	for i, p := range newSpine {
+		newIndex[p] = i
+	}
+	for i, p := range oldSpine {
+		if _, exists := matched[p]; exists {
+			if matched[p] != p {
+				moved[p] = matched[p]
+			}
+			continue
+		}
+		// The new chapter must sit between the same chapters as the old one
+		j := 0
+		if i > 0 {
+			prev, exists := matched[oldSpine[i-1]]
+			if !exists {
+				removed = append(removed, p)
+				continue
+			}
+			j = newIndex[prev] + 1
+		}
+		lined := j < len(newSpine) && !used[newSpine[j]]
+		if lined && i+1 < len(oldSpine) {
+			next, exists := matched[oldSpine[i+1]]
+			lined = exists && j+1 < len(newSpine) && newSpine[j+1] == next
+		} else if lined {
+			lined = j == len(newSpine)-1
+		}
+		if !lined {
+			removed = append(removed, p)
+			continue
+		}
+		matched[p] = newSpine[j]
+		moved[p] = newSpine[j]
+		used[newSpine[j]] = true
+	}
+	return moved, removed
+}
+
+// chapterPath finds the chapter of spine that the ContentID suffix tail of a
+// chapter refers to. Nickel uses '!' as well as '/' to separate the parts of
+// the path, and may add a fragment or index after it. The position of the
+// path in tail is returned along with it.
+func chapterPath(tail string, spine []string) (p string, start, end int) {
+	norm := strings.ReplaceAll(tail, "!", "/")
+	for _, s := range spine {
+		i := strings.LastIndex(norm, s)
+		if i < 0 || (i > 0 && norm[i-1] != '/') {
+			continue
+		}
+		j := i + len(s)
+		if j < len(norm) && norm[j] != '#' && norm[j] != '-' {
+			continue
+		}
+		if len(s) > len(p) {
+			p, start, end = s, i, j
+		}
+	}
+	return p, start, end
+}
+
+// remapChapters rewrites the ContentIDs of the chapters of the book cid that
+// moved in the new copy of the book. The annotations in chapters that were
+// removed are returned.
+func remapChapters(tx *nickelTx, caps *nickelCaps, cid, lpath string, r chapterRemap) ([]orphanedAnnotation, error) {
+	rows, err := tx.Query(`SELECT ContentID FROM content WHERE BookID=? AND ContentType=9
+		UNION SELECT ContentID FROM Bookmark WHERE VolumeID=?;`, cid, cid)
+	if err != nil {
+		return nil, fmt.Errorf("remapChapters: error getting chapters of %s: %w", cid, err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("remapChapters: row decoding error: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("remapChapters: %w", err)
+	}
+	var orphaned []orphanedAnnotation
+	for _, id := range ids {
+		if !strings.HasPrefix(id, cid) || len(id) == len(cid) {
+			continue
+		}
+		tail := id[len(cid):]
+		p, _, _ := chapterPath(tail, r.oldSpine)
+		if p == "" {
+			continue
+		}
+		if newTail, moved := remapChapterPath(tail, r); moved {
+			newID := cid + newTail
+			for _, col := range chapterIDcolumns {
+				if !caps.hasColumn(col.table, col.col) {
+					continue
+				}
+				query := fmt.Sprintf(`UPDATE "%[1]s" SET "%[2]s" = ? WHERE "%[2]s" = ?;`, col.table, col.col)
+				if _, err = tx.Exec(query, newID, id); err != nil {
+					return nil, fmt.Errorf("remapChapters: error updating %s.%s: %w", col.table, col.col, err)
+				}
+			}
+			continue
+		}
+		if !util.StringSliceContains(r.removed, p) {
+			continue
+		}
+		texts, err := tx.Query(`SELECT Text FROM Bookmark WHERE ContentID=?;`, id)
+		if err != nil {
+			return nil, fmt.Errorf("remapChapters: error getting annotations of %s: %w", id, err)
+		}
+		for texts.Next() {
+			var text *string
+			if err = texts.Scan(&text); err != nil {
+				texts.Close()
+				return nil, fmt.Errorf("remapChapters: row decoding error: %w", err)
+			}
+			orphaned = append(orphaned, orphanedAnnotation{Lpath: lpath, Chapter: p, Text: nullString(text)})
+		}
+		texts.Close()
+	}
+	if caps.hasColumn("content", "ChapterIDBookmarked") {
+		var bookmarked *string
+		if err = tx.QueryRow(`SELECT ChapterIDBookmarked FROM content WHERE ContentID=? AND ContentType=6;`, cid).Scan(&bookmarked); err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("remapChapters: error getting bookmarked chapter of %s: %w", cid, err)
+		}
+		if newPath, moved := remapChapterPath(nullString(bookmarked), r); moved {
+			if _, err = tx.Exec(`UPDATE content SET ChapterIDBookmarked=? WHERE ContentID=? AND ContentType=6;`, newPath, cid); err != nil {
+				return nil, fmt.Errorf("remapChapters: error updating bookmarked chapter of %s: %w", cid, err)
+			}
+		}
+	}
+	return orphaned, nil
+}
+
+// remapChapterPath rewrites the chapter that tail refers to, if it moved in
+// the new copy of the book. Only the part of the path that changed is
+// replaced, keeping Nickel's separators and anything after the path.
+func remapChapterPath(tail string, r chapterRemap) (string, bool) {
+	p, start, end := chapterPath(tail, r.oldSpine)
+	newPath, moved := r.moved[p]
+	if p == "" || !moved {
+		return tail, false
+	}
+	c := strings.LastIndex(commonPrefix(p, newPath), "/") + 1
+	return tail[:start+c] + newPath[c:] + tail[end:], true
+}
+
+// commonPrefix returns the longest common prefix of a and b
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
@@ -0,0 +1,80 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestMatchSpines(t *testing.T) {
+	tests := []struct {
+		old, new []string
+		moved    map[string]string
+		removed  []string
+	}{
+		{[]string{"a.xhtml", "b.xhtml"}, []string{"a.xhtml", "b.xhtml"}, map[string]string{}, nil},
+		// Moved to a new directory, matched by file name
+		{[]string{"a.xhtml", "b.xhtml"}, []string{"Text/a.xhtml", "b.xhtml"}, map[string]string{"a.xhtml": "Text/a.xhtml"}, nil},
+		// Every chapter renamed, matched by order
+		{[]string{"ch1.xhtml", "ch2.xhtml"}, []string{"part1.xhtml", "part2.xhtml"},
+			map[string]string{"ch1.xhtml": "part1.xhtml", "ch2.xhtml": "part2.xhtml"}, nil},
+		// Renamed between chapters that line up, matched by order
+		{[]string{"a.xhtml", "b.xhtml", "c.xhtml"}, []string{"a.xhtml", "x.xhtml", "c.xhtml"}, map[string]string{"b.xhtml": "x.xhtml"}, nil},
+		// Removed
+		{[]string{"a.xhtml", "b.xhtml", "c.xhtml"}, []string{"a.xhtml", "d.xhtml"}, map[string]string{}, []string{"b.xhtml", "c.xhtml"}},
+		// One chapter removed and another added elsewhere are not the same chapter
+		{[]string{"a.xhtml", "b.xhtml", "c.xhtml"}, []string{"a.xhtml", "c.xhtml", "d.xhtml"}, map[string]string{}, []string{"b.xhtml"}},
+		{[]string{"a.xhtml", "b.xhtml"}, []string{"c.xhtml", "a.xhtml"}, map[string]string{}, []string{"b.xhtml"}},
+	}
+	for _, tc := range tests {
+		moved, removed := matchSpines(tc.old, tc.new)
+		if !reflect.DeepEqual(moved, tc.moved) || !reflect.DeepEqual(removed, tc.removed) {
+			t.Errorf("matchSpines(%v, %v) = %v, %v, want %v, %v", tc.old, tc.new, moved, removed, tc.moved, tc.removed)
+		}
+	}
+}
+
+func TestRemapChapters(t *testing.T) {
+	dir, db := newTestNickelDB(t, `CREATE TABLE DbVersion (version INTEGER); INSERT INTO DbVersion VALUES (170);
+		CREATE TABLE content (ContentID TEXT, ContentType INT, BookID TEXT, ___FileSize INT, ChapterIDBookmarked TEXT);
+		CREATE TABLE Bookmark (BookmarkID TEXT, VolumeID TEXT, ContentID TEXT, Text TEXT);`)
+	cid := "file:///mnt/onboard/Book.kepub.epub"
+	if _, err := db.Exec(`INSERT INTO content VALUES (?1, 6, NULL, 100, 'OEBPS/a.xhtml#kobo.1.1'),
+			(?1 || '!OEBPS!a.xhtml', 9, ?1, 0, NULL), (?1 || '!OEBPS!b.xhtml', 9, ?1, 0, NULL);`, cid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO Bookmark VALUES ('1', ?1, ?1 || '!OEBPS!a.xhtml', 'kept'), ('2', ?1, ?1 || '!OEBPS!b.xhtml', 'lost');`, cid); err != nil {
+		t.Fatal(err)
+	}
+	k := &Kobo{
+		DBRootDir:     dir,
+		BKRootDir:     dir,
+		Metadata:      NewMetadataStore(1),
+		replacedBooks: map[string]int{cid: 120},
+		chapterRemaps: make(map[string]chapterRemap),
+	}
+	k.Metadata.set(cid, BookMeta{Meta: &uc.CalibreBookMeta{Lpath: "Book.kepub.epub"}})
+	oldSpine := []string{"a.xhtml", "b.xhtml"}
+	moved, removed := matchSpines(oldSpine, []string{"Text/a.xhtml", "c.xhtml", "d.xhtml"})
+	k.chapterRemaps[cid] = chapterRemap{oldSpine: oldSpine, moved: moved, removed: removed}
+
+	if err := k.updateReplacedBooks(); err != nil {
+		t.Fatal(err)
+	}
+	newID := cid + "!OEBPS!Text/a.xhtml"
+	for query, want := range map[string]string{
+		`SELECT ChapterIDBookmarked FROM content WHERE ContentType=6;`:                     "OEBPS/Text/a.xhtml#kobo.1.1",
+		`SELECT ContentID FROM Bookmark WHERE BookmarkID='1';`:                             newID,
+		`SELECT ContentID FROM content WHERE ContentID LIKE '%a.xhtml' AND ContentType=9;`: newID,
+	} {
+		var got string
+		if err := db.QueryRow(query).Scan(&got); err != nil || got != want {
+			t.Errorf("%s = %q, %v, want %q", query, got, err, want)
+		}
+	}
+	want := []orphanedAnnotation{{Lpath: "Book.kepub.epub", Chapter: "b.xhtml", Text: "lost"}}
+	if !reflect.DeepEqual(k.orphaned, want) {
+		t.Errorf("orphaned annotations = %v, want %v", k.orphaned, want)
+	}
+}
@@ -0,0 +1,200 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// seriesMatchOption controls how sideloaded series are matched with each
+// other, and with series of store books
+type seriesMatchOption struct {
+	Enabled           bool     `json:"enabled"`
+	IgnorePunctuation bool     `json:"ignorePunctuation"`
+	IgnorePrefixes    []string `json:"ignorePrefixes"`
+	IgnoreSuffixes    []string `json:"ignoreSuffixes"`
+}
+
+// Validate sets default prefixes and suffixes if there are none
+func (so *seriesMatchOption) Validate() {
+	if so.IgnorePrefixes == nil {
+		so.IgnorePrefixes = []string{"The", "A", "An"}
+	}
+	if so.IgnoreSuffixes == nil {
+		so.IgnoreSuffixes = []string{"Series", "Trilogy", "Saga"}
+	}
+}
+
+// normalize reduces a series name to the key used for matching. Exact
+// matching is used if fuzzy matching is disabled.
+func (so *seriesMatchOption) normalize(series string) string {
+	if !so.Enabled {
+		return series
+	}
+	s := strings.Join(strings.Fields(strings.ToLower(series)), " ")
+	for _, p := range so.IgnorePrefixes {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		// Deal with both "The Expanse" and "Expanse, The"
+		s = strings.TrimPrefix(s, p+" ")
+		s = strings.TrimSuffix(s, ", "+p)
+	}
+	for _, sfx := range so.IgnoreSuffixes {
+		sfx = strings.ToLower(strings.TrimSpace(sfx))
+		if sfx != "" {
+			s = strings.TrimSuffix(s, " "+sfx)
+		}
+	}
+	// Punctuation is removed last, so that "Expanse, The" is still recognised
+	if so.IgnorePunctuation {
+		s = strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}), " ")
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return strings.ToLower(series)
+	}
+	return s
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// storeSeries is a series of a store book, along with its Nickel SeriesID
+type storeSeries struct {
+	Series   string
+	SeriesID string
+}
+
+// seriesMatch is the SeriesID a sideloaded series will be given
+type seriesMatch struct {
+	Series      string `json:"series"`
+	SeriesID    string `json:"seriesId"`
+	StoreSeries string `json:"storeSeries,omitempty"`
+}
+
+// matchSeries maps each sideloaded series to a SeriesID. Series that match a
+// store series use its SeriesID. Otherwise sideloaded series that match each
+// other share a SeriesID, which is the first of their names in sort order.
+func (so *seriesMatchOption) matchSeries(sideloaded []string, store []storeSeries) map[string]seriesMatch {
+	sortedStore := append([]storeSeries(nil), store...)
+	sort.Slice(sortedStore, func(i, j int) bool { return sortedStore[i].Series < sortedStore[j].Series })
+	storeKeys := make(map[string]storeSeries, len(store))
+	for _, ss := range sortedStore {
+		key := so.normalize(ss.Series)
+		// Prefer the closest name if several store series normalize to the same key
+		if _, exists := storeKeys[key]; !exists || strings.EqualFold(ss.Series, key) {
+			storeKeys[key] = ss
+		}
+	}
+	sorted := append([]string(nil), sideloaded...)
+	sort.Strings(sorted)
+	groupIDs := make(map[string]string)
+	matches := make(map[string]seriesMatch, len(sorted))
+	for _, series := range sorted {
+		if _, done := matches[series]; done || series == "" {
+			continue
+		}
+		key := so.normalize(series)
+		m := seriesMatch{Series: series}
+		if ss, exists := storeKeys[key]; exists {
+			m.SeriesID, m.StoreSeries = ss.SeriesID, ss.Series
+		} else if id, exists := groupIDs[key]; exists {
+			m.SeriesID = id
+		} else {
+			m.SeriesID = series
+			groupIDs[key] = series
+		}
+		matches[series] = m
+	}
+	return matches
+}
+
+// readStoreSeries gets the series, and SeriesID's, of store books
+func readStoreSeries(q queryer) ([]storeSeries, error) {
+	rows, err := q.Query(`SELECT DISTINCT Series, SeriesID FROM content
+		WHERE ContentType = 6 AND ContentID NOT LIKE 'file://%'
+		AND Series IS NOT NULL AND Series <> '' AND SeriesID IS NOT NULL AND SeriesID <> '';`)
+	if err != nil {
+		return nil, fmt.Errorf("readStoreSeries: error getting store series: %w", err)
+	}
+	defer rows.Close()
+	var store []storeSeries
+	for rows.Next() {
+		var ss storeSeries
+		if err = rows.Scan(&ss.Series, &ss.SeriesID); err != nil {
+			return nil, fmt.Errorf("readStoreSeries: row decoding error: %w", err)
+		}
+		store = append(store, ss)
+	}
+	return store, rows.Err()
+}
+
+// previewSeriesMatches shows how the series of sideloaded books would be
+// matched using opts. Series are taken from the metadata cache if it has been
+// read, otherwise from the Nickel database.
+func (k *Kobo) previewSeriesMatches(opts seriesMatchOption) ([]seriesMatch, error) {
+	nickelDB, err := k.openNickelDB(true)
+	if err != nil {
+		return nil, fmt.Errorf("previewSeriesMatches: %w", err)
+	}
+	defer nickelDB.Close()
+	caps, err := k.capabilities(nickelDB)
+	if err != nil {
+		return nil, fmt.Errorf("previewSeriesMatches: %w", err)
+	}
+	// Without SeriesID's, there are no store series to match
+	var store []storeSeries
+	if caps.seriesID() {
+		if store, err = readStoreSeries(nickelDB); err != nil {
+			return nil, fmt.Errorf("previewSeriesMatches: %w", err)
+		}
+	}
+	var sideloaded []string
+	if k.Metadata != nil && k.Metadata.Len() > 0 {
+		sideloaded = k.sideloadedSeries()
+	} else {
+		rows, err := nickelDB.Query(`SELECT DISTINCT Series FROM content
+			WHERE ContentType = 6 AND ContentID LIKE 'file://%' AND Series IS NOT NULL AND Series <> '';`)
+		if err != nil {
+			return nil, fmt.Errorf("previewSeriesMatches: error getting sideloaded series: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var series string
+			if err = rows.Scan(&series); err != nil {
+				return nil, fmt.Errorf("previewSeriesMatches: row decoding error: %w", err)
+			}
+			sideloaded = append(sideloaded, series)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("previewSeriesMatches: rows error: %w", err)
+		}
+	}
+	opts.Validate()
+	matches := make([]seriesMatch, 0, len(sideloaded))
+	for _, m := range opts.matchSeries(sideloaded, store) {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Series < matches[j].Series })
+	return matches, nil
+}
+
+// sideloadedSeries gets the series of every book in the metadata cache
+func (k *Kobo) sideloadedSeries() []string {
+	var series []string
+	k.Metadata.Iterate(func(cid string, m BookMeta) bool {
+		if m.Meta != nil && m.Meta.Series != nil && *m.Meta.Series != "" {
+			series = append(series, *m.Meta.Series)
+		}
+		return true
+	})
+	return series
+}
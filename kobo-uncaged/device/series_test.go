@@ -0,0 +1,27 @@
+package device
+
+import "testing"
+
+func TestMatchSeries(t *testing.T) {
+	opts := seriesMatchOption{Enabled: true, IgnorePunctuation: true}
+	opts.Validate()
+	store := []storeSeries{{Series: "Expanse", SeriesID: "store-expanse"}}
+	sideloaded := []string{"The Expanse", "Expanse, The", "Discworld", "The Discworld Series", "Culture"}
+	want := map[string]string{
+		"The Expanse":          "store-expanse",
+		"Expanse, The":         "store-expanse",
+		"Discworld":            "Discworld",
+		"The Discworld Series": "Discworld",
+		"Culture":              "Culture",
+	}
+	matches := opts.matchSeries(sideloaded, store)
+	for series, id := range want {
+		if got := matches[series].SeriesID; got != id {
+			t.Errorf("matchSeries(%q) = %q, want %q", series, got, id)
+		}
+	}
+	opts.Enabled = false
+	if got := opts.matchSeries([]string{"The Expanse"}, store)["The Expanse"].SeriesID; got != "The Expanse" {
+		t.Errorf("matchSeries with matching disabled = %q, want %q", got, "The Expanse")
+	}
+}
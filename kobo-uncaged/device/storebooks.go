@@ -0,0 +1,107 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// storeLpathPrefix is the lpath prefix of store books. It matches where
+// Nickel keeps them, relative to the root of the internal storage.
+const storeLpathPrefix = ".kobo/kepub/"
+
+// storeMimeType is the mimetype Nickel gives store kepubs
+const storeMimeType = "application/x-kobo-epub+zip"
+
+// IsStoreBook tests whether lpath refers to a store book. Store books are
+// read-only, Kobo UNCaGED must never modify or delete them.
+func (k *Kobo) IsStoreBook(lpath string) bool {
+	return strings.HasPrefix(lpath, storeLpathPrefix)
+}
+
+// readStoreBooks reads the metadata of downloaded store kepubs from the
+// Nickel database, so they can be shown to Calibre.
+func (k *Kobo) readStoreBooks(nickelDB *sql.DB, timeSpentCol string) error {
+	rows, err := nickelDB.Query(`SELECT ContentID, Title, Attribution, Description, Publisher, Series, SeriesNumber,
+		ISBN, Language, DateCreated, ___SyncTime, ___FileSize, ReadStatus, ___PercentRead, DateLastRead, `+timeSpentCol+`
+		FROM content
+		WHERE ContentType=6
+		AND ContentID NOT LIKE 'file://%'
+		AND MimeType=?
+		AND (IsDownloaded='true' OR IsDownloaded=1)
+		AND ___FileSize>0;`, storeMimeType)
+	if err != nil {
+		return fmt.Errorf("readStoreBooks: error getting store book rows: %w", err)
+	}
+	defer rows.Close()
+	k.StoreBooks = make(map[string]BookMeta)
+	for rows.Next() {
+		var cid string
+		var title, attr, desc, publisher, series, seriesNum, isbn, lang, created, synced, lastRead *string
+		var size, readStatus, percentRead, timeSpent *int
+		if err = rows.Scan(&cid, &title, &attr, &desc, &publisher, &series, &seriesNum,
+			&isbn, &lang, &created, &synced, &size, &readStatus, &percentRead, &lastRead, &timeSpent); err != nil {
+			return fmt.Errorf("readStoreBooks: store book row decoding error: %w", err)
+		}
+		mime := storeMimeType
+		md := uc.CalibreBookMeta{
+			Lpath:       storeLpathPrefix + cid,
+			Title:       nullString(title),
+			Comments:    desc,
+			Publisher:   publisher,
+			Series:      series,
+			Mime:        &mime,
+			Identifiers: make(map[string]string),
+			// Store books don't have a Calibre UUID, so derive a stable one from the ContentID
+			UUID: uuid.NewSHA1(uuid.NameSpaceOID, []byte(cid)).String(),
+		}
+		for _, a := range strings.Split(nullString(attr), ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				md.Authors = append(md.Authors, a)
+			}
+		}
+		if seriesNum != nil {
+			if index, err := strconv.ParseFloat(*seriesNum, 64); err == nil {
+				md.SeriesIndex = &index
+			}
+		}
+		if isbn := nullString(isbn); isbn != "" {
+			md.Identifiers["isbn"] = isbn
+		}
+		if lang := nullString(lang); lang != "" {
+			md.Languages = []string{lang}
+		}
+		if t := parseNickelTime(created); t != nil {
+			pd := uc.ConvertTime(t.UTC())
+			md.Pubdate = &pd
+		}
+		// The sync time only changes when Nickel updates the book, so is a
+		// reasonable last modified time
+		if t := parseNickelTime(synced); t != nil {
+			lm := uc.ConvertTime(t.UTC())
+			md.LastModified = &lm
+		}
+		if size != nil {
+			md.Size = *size
+		}
+		rs := readingState{lastRead: parseNickelTime(lastRead)}
+		if readStatus != nil {
+			rs.readStatus = *readStatus
+		}
+		if percentRead != nil {
+			rs.percentRead = *percentRead
+		}
+		if timeSpent != nil {
+			rs.timeSpent = *timeSpent
+		}
+		k.StoreBooks[md.Lpath] = BookMeta{Meta: &md, reading: &rs}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("readStoreBooks: store book rows error: %w", err)
+	}
+	return nil
+}
@@ -18,10 +18,11 @@
 package device
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bamiaux/rez"
 	"github.com/godbus/dbus/v5"
@@ -37,19 +38,34 @@ type firmwareVersion string
 
 // KuOptions contains some options that are required
 type KuOptions struct {
-	PreferSDCard    bool                    `json:"preferSDCard"`
-	PreferKepub     bool                    `json:"preferKepub"`
-	EnableDebug     bool                    `json:"enableDebug"`
-	Thumbnail       thumbnailOption         `json:"thumbnail"`
-	LibOptions      map[string]KuLibOptions `json:"libOptions"`
-	DirectConnIndex int                     `json:"directConnIndex"`
-	DirectConn      []uc.CalInstance        `json:"directConn"`
-	ExcludeFormats  []string                `json:"excludeFormats"`
+	PreferSDCard      bool                    `json:"preferSDCard"`
+	PreferKepub       bool                    `json:"preferKepub"`
+	EnableDebug       bool                    `json:"enableDebug"`
+	Thumbnail         thumbnailOption         `json:"thumbnail"`
+	LibOptions        map[string]KuLibOptions `json:"libOptions"`
+	DirectConnIndex   int                     `json:"directConnIndex"`
+	DirectConn        []uc.CalInstance        `json:"directConn"`
+	ExcludeFormats    []string                `json:"excludeFormats"`
+	MetadataFields    metadataFieldOption     `json:"metadataFields"`
+	ShowStoreBooks    bool                    `json:"showStoreBooks"`
+	SeriesMatching    seriesMatchOption       `json:"seriesMatching"`
+	ListPendingBooks  bool                    `json:"listPendingBooks"`
+	PruneMissingBooks bool                    `json:"pruneMissingBooks"`
+	DryRun            bool                    `json:"dryRun"`
 }
 
 // KuLibOptions contains per-library options
 type KuLibOptions struct {
-	SubtitleColumn string `json:"subtitleColumn"`
+	SubtitleColumn    string `json:"subtitleColumn"`
+	ReadStatusColumn  string `json:"readStatusColumn"`
+	PercentReadColumn string `json:"percentReadColumn"`
+	LastReadColumn    string `json:"lastReadColumn"`
+	TimeSpentColumn   string `json:"timeSpentColumn"`
+	MarkReadColumn    string `json:"markReadColumn"`
+	// CollectionsColumn is "tags", "series" or a text-like custom column
+	CollectionsColumn      string `json:"collectionsColumn"`
+	RemoveEmptyCollections bool   `json:"removeEmptyCollections"`
+	AnnotationsColumn      string `json:"annotationsColumn"`
 }
 
 type webUIinfo struct {
@@ -64,6 +80,14 @@ type webUIinfo struct {
 	ConfigPath       string   `json:"configPath"`
 	InstancePath     string   `json:"instancePath"`
 	LibInfoPath      string   `json:"libInfoPath"`
+	ResultsPath      string   `json:"resultsPath"`
+	AnnotationsPath  string   `json:"annotationsPath"`
+	SeriesPath       string   `json:"seriesPath"`
+	ReconcilePath    string   `json:"reconcilePath"`
+	DryRunPath       string   `json:"dryRunPath"`
+	OrphansPath      string   `json:"orphansPath"`
+	BackupsPath      string   `json:"backupsPath"`
+	Warnings         []string `json:"warnings"`
 }
 
 type webConfig struct {
@@ -71,9 +95,11 @@ type webConfig struct {
 	err  error
 }
 
+// webLibOpts holds the library options, and the Calibre fields
+// available to each type of option
 type webLibOpts struct {
-	CurrSel        int      `json:"currSel"`
-	SubtitleFields []string `json:"subtitleFields"`
+	Opts   KuLibOptions        `json:"opts"`
+	Fields map[string][]string `json:"fields"`
 }
 
 // WebMsg is used to send messages to the web client
@@ -84,6 +110,7 @@ type WebMsg struct {
 	GetCalInstance bool
 	GetLibInfo     bool
 	Finished       string
+	Warning        string
 }
 
 type calPassCache map[string]*calPassword
@@ -105,7 +132,10 @@ type Kobo struct {
 	BKRootDir       string
 	ContentIDprefix cidPrefix
 	UseSDCard       bool
-	MetadataMap     map[string]BookMeta
+	Metadata        *MetadataStore
+	StoreBooks      map[string]BookMeta
+	unmatchedMD     map[string]json.RawMessage
+	warnedFiles     int
 	SeriesIDMap     map[string]string
 	LibInfo         uc.CalibreLibraryInfo
 	PassCache       calPassCache
@@ -113,7 +143,17 @@ type Kobo struct {
 	mux             *httprouter.Router
 	rend            *render.Render
 	webInfo         *webUIinfo
-	replSQLWriter   *sqlWriter
+	replacedBooks   map[string]int
+	deletedBooks    map[string]deletedBook
+	receivedBooks   map[string]receivedBook
+	chapterRemaps   map[string]chapterRemap
+	orphaned        []orphanedAnnotation
+	updateResults   []bookUpdateResult
+	reconciled      []reconcileEntry
+	dryRun          *dryRunLog
+	backupOnce      sync.Once
+	backupErr       error
+	caps            *nickelCaps
 	ndbConn         *dbus.Conn
 	ndbObj          dbus.BusObject
 	calInstances    []uc.CalInstance
@@ -128,13 +168,46 @@ type Kobo struct {
 	UCExitChan      chan<- bool
 	calInstChan     chan uc.CalInstance
 	viewSignal      chan *dbus.Signal
+	rescanMu        sync.Mutex
+	rescanDone      chan bool
+	rescanWarned    bool
+	// sessionMu guards the session state the web UI handlers change
+	sessionMu sync.Mutex
+	// sessionStarted is set once the client has sent the config to start with
+	sessionStarted bool
+	// snapshotRestored is set once a snapshot has replaced the Nickel DB
+	snapshotRestored bool
 }
 
 // BookMeta stores information about metadata for each book
 type BookMeta struct {
-	UpdatedBook bool
-	NewBook     bool
 	Meta        *uc.CalibreBookMeta
+	reading     *readingState
+	annotations []annotation
+	// sha256 is the digest of the book file, as last received from Calibre
+	sha256 string
+}
+
+// SHA256 gets the hex encoded SHA-256 digest of the book file, as last
+// received from Calibre. It is empty if the book was received before digests
+// were recorded.
+func (m BookMeta) SHA256() string {
+	return m.sha256
+}
+
+// mdRecord is a metadata.calibre record. The digest of the book file is
+// stored alongside Calibre's metadata.
+type mdRecord struct {
+	*uc.CalibreBookMeta
+	SHA256 string `json:"ku_sha256,omitempty"`
+}
+
+// readingState is the reading progress of a book, as recorded by Nickel
+type readingState struct {
+	readStatus  int
+	percentRead int
+	lastRead    *time.Time
+	timeSpent   int
 }
 
 // MetaIterator Kobo UNCaGED to lazy load book metadata
@@ -150,7 +223,7 @@ func NewMetaIter(k *Kobo) *MetaIterator {
 	return &iter
 }
 
-// Add a client ID to the iterator
+// Add a client ID to the iterator. Store books are added by their lpath.
 func (m *MetaIterator) Add(cid string) {
 	m.cidList = append(m.cidList, cid)
 }
@@ -172,13 +245,39 @@ func (m *MetaIterator) Count() int {
 // Get the metadata of the current iteration
 func (m *MetaIterator) Get() (uc.CalibreBookMeta, error) {
 	if m.Count() > 0 && m.cidIndex >= 0 {
-		if md, exists := m.k.MetadataMap[m.cidList[m.cidIndex]]; exists && md.Meta != nil {
-			return *md.Meta, nil
+		md, exists := m.k.Metadata.Get(m.cidList[m.cidIndex])
+		if !exists {
+			md, exists = m.k.StoreBooks[m.cidList[m.cidIndex]]
+		}
+		if exists && md.Meta != nil {
+			meta := *md.Meta
+			m.k.setReadingColumns(&meta, md.reading)
+			m.k.setAnnotationsColumn(&meta, md.annotations)
+			return meta, nil
 		}
 	}
 	return uc.CalibreBookMeta{}, fmt.Errorf("no metadata to get")
 }
 
+// bookUpdateResult records the outcome of updating a single book
+// in the Nickel database
+type bookUpdateResult struct {
+	Title string `json:"title"`
+	Lpath string `json:"lpath"`
+	Err   string `json:"err"`
+}
+
+// metadataFieldOption selects which Calibre fields replace the
+// values Nickel parsed from the book file
+type metadataFieldOption struct {
+	Title     bool `json:"title"`
+	Authors   bool `json:"authors"`
+	Publisher bool `json:"publisher"`
+	Language  bool `json:"language"`
+	ISBN      bool `json:"isbn"`
+	Pubdate   bool `json:"pubdate"`
+}
+
 type uncagedPassword struct {
 	currPassIndex int
 	passwordList  []string
@@ -240,40 +339,3 @@ func (to *thumbnailOption) SetRezFilter() {
 		to.rezFilter = rez.NewBicubicFilter()
 	}
 }
-
-type sqlWriter struct {
-	sqlFile       *os.File
-	sqlBuffWriter *bufio.Writer
-}
-
-func newSQLWriter(path string) (*sqlWriter, error) {
-	var err error
-	s := &sqlWriter{}
-	if s.sqlFile, err = os.Create(path); err != nil {
-		return nil, err
-	}
-	s.sqlBuffWriter = bufio.NewWriter(s.sqlFile)
-	return s, nil
-}
-
-func (s *sqlWriter) writeBegin() {
-	s.sqlBuffWriter.WriteString("BEGIN;\n")
-}
-
-func (s *sqlWriter) writeCommit() {
-	s.sqlBuffWriter.WriteString("COMMIT;\n")
-}
-
-func (s *sqlWriter) writeQuery(query string) {
-	s.sqlBuffWriter.WriteString(query)
-	// Make sure our query always ends with a terminating ';'
-	if !strings.HasSuffix(query, ";") {
-		s.sqlBuffWriter.WriteRune(';')
-	}
-	s.sqlBuffWriter.WriteRune('\n')
-}
-
-func (s *sqlWriter) close() {
-	defer s.sqlFile.Close()
-	s.sqlBuffWriter.Flush()
-}
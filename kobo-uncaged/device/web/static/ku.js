@@ -50,6 +50,7 @@ function setupSSE() {
         getKUJson(kuInfo.libInfoPath, showLibraryInfo);
     });
     msgEvtSrc.addEventListener('kuFinished', showFinishedMsg);
+    msgEvtSrc.addEventListener('warning', showWarning);
 }
 function setupEventHandlers() {
     var startBtn = document.getElementById('cfgStartBtn');
@@ -107,12 +108,56 @@ function setupEventHandlers() {
         });
         pwInput.dataset.eventAuthLoginEnt = "true";
     }
+    var annotationsBtn = document.getElementById('cfgAnnotationsBtn');
+    if (annotationsBtn.dataset.eventAnnotations === 'false') {
+        annotationsBtn.addEventListener('click', function (ev) {
+            getKUJson(kuInfo.annotationsPath, showAnnotations);
+        });
+        annotationsBtn.dataset.eventAnnotations = 'true';
+    }
+    var annotationsBackBtn = document.getElementById('annotationsBackBtn');
+    if (annotationsBackBtn.dataset.eventAnnotationsBack === 'false') {
+        annotationsBackBtn.addEventListener('click', function (ev) {
+            hideAllComponents();
+            document.getElementById('kuconfig').style.display = 'block';
+        });
+        annotationsBackBtn.dataset.eventAnnotationsBack = 'true';
+    }
+    var backupsBtn = document.getElementById('cfgBackupsBtn');
+    if (backupsBtn.dataset.eventBackups === 'false') {
+        backupsBtn.addEventListener('click', function (ev) {
+            document.getElementById('ku-backups-msg').textContent = '';
+            getKUJson(kuInfo.backupsPath, showBackups);
+        });
+        backupsBtn.dataset.eventBackups = 'true';
+    }
+    var backupsBackBtn = document.getElementById('backupsBackBtn');
+    if (backupsBackBtn.dataset.eventBackupsBack === 'false') {
+        backupsBackBtn.addEventListener('click', function (ev) {
+            hideAllComponents();
+            document.getElementById('kuconfig').style.display = 'block';
+        });
+        backupsBackBtn.dataset.eventBackupsBack = 'true';
+    }
+    var seriesBtn = document.getElementById('cfgSeriesBtn');
+    if (seriesBtn.dataset.eventSeries === 'false') {
+        seriesBtn.addEventListener('click', previewSeries);
+        seriesBtn.dataset.eventSeries = 'true';
+    }
+    var seriesBackBtn = document.getElementById('seriesBackBtn');
+    if (seriesBackBtn.dataset.eventSeriesBack === 'false') {
+        seriesBackBtn.addEventListener('click', function (ev) {
+            hideAllComponents();
+            document.getElementById('kuconfig').style.display = 'block';
+        });
+        seriesBackBtn.dataset.eventSeriesBack = 'true';
+    }
     var instList = document.getElementById('calInstanceList');
     if (instList.dataset.eventInstances === "false") {
         instList.addEventListener('click', selectCalInstance);
         instList.dataset.eventInstances = "true";
     }
-    var cfgLabels = document.querySelectorAll(".ku-cfg-row > label, #excludeFormatsLabel");
+    var cfgLabels = document.querySelectorAll(".ku-cfg-row > label, #excludeFormatsLabel, #metadataFieldsLabel");
     for (var i = 0; i < cfgLabels.length; i++) {
         cfgLabels[i].addEventListener('click', showCfgHelpText);
     }
@@ -268,27 +313,39 @@ function selectCalInstance(ev) {
 function showLibraryInfo(resp) {
     if (resp.status === 200) {
         libInfo = JSON.parse(resp.responseText);
-        var fieldSel = document.getElementById('kuSubtitleColumn');
-        for (var i = 0; i < libInfo.subtitleFields.length; i++) {
-            var fieldOpt = document.createElement('option');
-            fieldOpt.value = libInfo.subtitleFields[i];
-            fieldOpt.innerHTML = libInfo.subtitleFields[i];
-            if (libInfo.currSel === i) {
-                fieldOpt.selected = true;
+        var fieldSels = document.querySelectorAll('#ku-lib-opts > select');
+        for (var i = 0; i < fieldSels.length; i++) {
+            var fieldSel = fieldSels[i];
+            var fields = libInfo.fields[fieldSel.dataset.libFields];
+            fieldSel.innerHTML = '';
+            for (var j = 0; j < fields.length; j++) {
+                var fieldOpt = document.createElement('option');
+                fieldOpt.value = fields[j];
+                fieldOpt.innerHTML = fields[j];
+                if (libInfo.opts[fieldSel.dataset.libOpt] === fields[j]) {
+                    fieldOpt.selected = true;
+                }
+                fieldSel.appendChild(fieldOpt);
             }
-            fieldSel.appendChild(fieldOpt);
+            fieldSel.addEventListener('change', sendLibraryInfo);
+            fieldSel.disabled = false;
+        }
+        var optChks = document.querySelectorAll('#ku-lib-opts > input[type=checkbox]');
+        for (var i = 0; i < optChks.length; i++) {
+            optChks[i].checked = libInfo.opts[optChks[i].dataset.libOpt] === true;
+            optChks[i].addEventListener('change', sendLibraryInfo);
+            optChks[i].disabled = false;
         }
-        fieldSel.addEventListener('change', sendLibraryInfo);
-        fieldSel.disabled = false;
     }
 }
 
 function sendLibraryInfo(ev) {
     var el = ev.target;
-    if (el.id === 'kuSubtitleColumn') {
-        libInfo.currSel = 0;
-        if (el.selectedIndex > 0) {
-            libInfo.currSel = el.selectedIndex;
+    if ('libOpt' in el.dataset) {
+        if (el.type === 'checkbox') {
+            libInfo.opts[el.dataset.libOpt] = el.checked;
+        } else {
+            libInfo.opts[el.dataset.libOpt] = el.options[el.selectedIndex].value;
         }
     }
     var xhr = new XMLHttpRequest();
@@ -301,6 +358,49 @@ function sendLibraryInfo(ev) {
     xhr.send(JSON.stringify(libInfo));
 }
 
+function splitWords(str) {
+    var words = [];
+    var parts = str.split(',');
+    for (var i = 0; i < parts.length; i++) {
+        var w = parts[i].trim();
+        if (w !== '') {
+            words.push(w);
+        }
+    }
+    return words;
+}
+function getSeriesOpts() {
+    return {
+        enabled: document.getElementById('seriesMatching').checked,
+        ignorePunctuation: document.getElementById('seriesIgnorePunctuation').checked,
+        ignorePrefixes: splitWords(document.getElementById('seriesIgnorePrefixes').value),
+        ignoreSuffixes: splitWords(document.getElementById('seriesIgnoreSuffixes').value)
+    };
+}
+function previewSeries(ev) {
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', kuInfo.seriesPath);
+    xhr.onload = function () {
+        if (xhr.status !== 200) {
+            console.log('previewSeries status code expected was 200, got ' + xhr.status);
+            return;
+        }
+        hideAllComponents();
+        var matches = JSON.parse(xhr.responseText);
+        var l = document.getElementById('ku-series-matches');
+        l.innerHTML = '';
+        if (matches.length === 0) {
+            l.innerHTML = '<li>No sideloaded series found</li>';
+        }
+        for (var i = 0; i < matches.length; i++) {
+            var matchItem = document.createElement('li');
+            matchItem.textContent = matches[i].series + ' :: ' + (matches[i].storeSeries ? 'Store series ' + matches[i].storeSeries : matches[i].seriesId);
+            l.appendChild(matchItem);
+        }
+        document.getElementById('kuseries').style.display = 'block';
+    };
+    xhr.send(JSON.stringify(getSeriesOpts()));
+}
 function sendConfig() {
     displayButtonState('cfgExitBtn', true);
     var gl = document.getElementById('generateLevel');
@@ -308,6 +408,10 @@ function sendConfig() {
     kuConfig.opts.preferSDCard = document.getElementById('preferSDCard').checked;
     kuConfig.opts.preferKepub = document.getElementById('preferKepub').checked;
     kuConfig.opts.enableDebug = document.getElementById('enableDebug').checked;
+    kuConfig.opts.showStoreBooks = document.getElementById('showStoreBooks').checked;
+    kuConfig.opts.listPendingBooks = document.getElementById('listPendingBooks').checked;
+    kuConfig.opts.pruneMissingBooks = document.getElementById('pruneMissingBooks').checked;
+    kuConfig.opts.dryRun = document.getElementById('dryRun').checked;
     var exclFormats = [];
     var fmtLabels = document.querySelectorAll('#excludeFormatsContainer label');
     for(var i = 0; i < fmtLabels.length; i++) {
@@ -317,6 +421,11 @@ function sendConfig() {
         }
     }
     kuConfig.opts.excludeFormats = exclFormats;
+    var mdFields = document.querySelectorAll('#metadataFieldsContainer input');
+    for(var i = 0; i < mdFields.length; i++) {
+        kuConfig.opts.metadataFields[mdFields[i].dataset.mdField] = mdFields[i].checked;
+    }
+    kuConfig.opts.seriesMatching = getSeriesOpts();
     kuConfig.opts.thumbnail.generateLevel = gl.options[gl.selectedIndex].value;
     kuConfig.opts.thumbnail.resizeAlgorithm = rs.options[rs.selectedIndex].value;
     var jpgQuality = parseInt(document.getElementById('jpegQuality').value);
@@ -343,16 +452,159 @@ function exitKU() {
         if (resp.status === 204) {
             hideAllComponents();
             var exitDiv = document.getElementById('kuexit');
-            exitDiv.innerHTML = '<h2>Goodbye!</h2>';
+            document.getElementById('ku-finished-msg').innerHTML = '<h2>Goodbye!</h2>';
             exitDiv.style.display = 'block';
         }
     });
 }
+function showWarning(ev) {
+    var warning = document.createElement('p');
+    warning.textContent = ev.data;
+    document.getElementById('ku-warnings').appendChild(warning);
+}
 function showFinishedMsg(ev) {
     hideAllComponents();
     var exitDiv = document.getElementById('kuexit');
-    exitDiv.innerHTML = '<h2>' + ev.data + '</h2>';
+    document.getElementById('ku-finished-msg').innerHTML = '<h2>' + ev.data + '</h2>';
     exitDiv.style.display = 'block';
+    getKUJson(kuInfo.resultsPath, showResults);
+    getKUJson(kuInfo.reconcilePath, showReconciled);
+    getKUJson(kuInfo.dryRunPath, showDryRun);
+    getKUJson(kuInfo.orphansPath, showOrphans);
+}
+function showResults(resp) {
+    if (resp.status === 200) {
+        var results = JSON.parse(resp.responseText);
+        var l = document.getElementById('ku-results');
+        l.innerHTML = '';
+        for (var i = 0; i < results.length; i++) {
+            var resItem = document.createElement('li');
+            resItem.textContent = results[i].title + (results[i].err ? ' :: Failed: ' + results[i].err : ' :: Updated');
+            l.appendChild(resItem);
+        }
+    }
+}
+function showReconciled(resp) {
+    if (resp.status === 200) {
+        var entries = JSON.parse(resp.responseText);
+        var descriptions = {
+            pending: 'Not imported by the Kobo yet',
+            missingFile: 'Book file missing',
+            staleRecord: 'Stale metadata.calibre record'
+        };
+        var l = document.getElementById('ku-reconciled');
+        l.innerHTML = '';
+        for (var i = 0; i < entries.length; i++) {
+            var item = document.createElement('li');
+            var status = descriptions[entries[i].kind];
+            if (entries[i].listed) {
+                status += ', shown to Calibre';
+            } else if (entries[i].pruned) {
+                status += ', removed';
+            }
+            item.textContent = (entries[i].title || entries[i].lpath) + ' :: ' + status;
+            l.appendChild(item);
+        }
+    }
+}
+function showDryRun(resp) {
+    if (resp.status === 200) {
+        var changes = JSON.parse(resp.responseText);
+        var l = document.getElementById('ku-dryrun');
+        l.innerHTML = '';
+        for (var i = 0; i < changes.length; i++) {
+            var item = document.createElement('li');
+            item.textContent = 'Dry run :: ' + changes[i];
+            l.appendChild(item);
+        }
+    }
+}
+function showOrphans(resp) {
+    if (resp.status === 200) {
+        var orphaned = JSON.parse(resp.responseText);
+        var l = document.getElementById('ku-orphans');
+        l.innerHTML = '';
+        for (var i = 0; i < orphaned.length; i++) {
+            var item = document.createElement('li');
+            item.textContent = orphaned[i].lpath + ' :: Annotation not reattached (' + orphaned[i].chapter + '): ' + orphaned[i].text;
+            l.appendChild(item);
+        }
+    }
+}
+function showAnnotations(resp) {
+    if (resp.status === 200) {
+        hideAllComponents();
+        var files = JSON.parse(resp.responseText);
+        var l = document.getElementById('ku-annotation-files');
+        l.innerHTML = '';
+        if (files.length === 0) {
+            l.innerHTML = '<li>No annotation backups yet</li>';
+        }
+        for (var i = 0; i < files.length; i++) {
+            var fileItem = document.createElement('li');
+            var fileLink = document.createElement('a');
+            fileLink.href = encodeURI(files[i].path);
+            fileLink.download = '';
+            fileLink.textContent = files[i].lpath;
+            fileItem.appendChild(fileLink);
+            l.appendChild(fileItem);
+        }
+        document.getElementById('kuannotations').style.display = 'block';
+    }
+}
+function showBackups(resp) {
+    if (resp.status === 200) {
+        hideAllComponents();
+        var snapshots = JSON.parse(resp.responseText);
+        var l = document.getElementById('ku-snapshots');
+        l.innerHTML = '';
+        if (snapshots.length === 0) {
+            l.innerHTML = '<li>No backups yet</li>';
+        }
+        for (var i = 0; i < snapshots.length; i++) {
+            var snapItem = document.createElement('li');
+            var restoreBtn = document.createElement('button');
+            restoreBtn.type = 'button';
+            restoreBtn.textContent = 'Restore';
+            restoreBtn.dataset.snapshot = snapshots[i].name;
+            restoreBtn.addEventListener('click', restoreBackup);
+            snapItem.textContent = new Date(snapshots[i].created).toLocaleString() + ' (' + snapshots[i].files.join(', ') + ') ';
+            snapItem.appendChild(restoreBtn);
+            l.appendChild(snapItem);
+        }
+        document.getElementById('kubackups').style.display = 'block';
+    }
+}
+function restoreBackup(ev) {
+    var name = ev.target.dataset.snapshot;
+    if (!confirm('Replace the Kobo database and metadata.calibre with the backup from ' + name + '?')) {
+        return;
+    }
+    var msg = document.getElementById('ku-backups-msg');
+    msg.textContent = 'Restoring...';
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', kuInfo.backupsPath);
+    xhr.onload = function () {
+        if (xhr.status === 200) {
+            var resp = JSON.parse(xhr.responseText);
+            // Nickel still has the old library loaded, so nothing else may be done until the Kobo restarts
+            var text = resp.restart ?
+                'Backup restored. Kobo UNCaGED will now exit and restart your Kobo, so the restored library is loaded.' :
+                'Backup restored. Kobo UNCaGED will now exit. Restart your Kobo before reading or connecting again, so the restored library is loaded.';
+            alert(text);
+            hideAllComponents();
+            var heading = document.createElement('h2');
+            heading.textContent = text;
+            var finishedMsg = document.getElementById('ku-finished-msg');
+            finishedMsg.innerHTML = '';
+            finishedMsg.appendChild(heading);
+            document.getElementById('kuexit').style.display = 'block';
+            getKUJson(kuInfo.exitPath, function(resp) {});
+        } else {
+            msg.textContent = 'Restoring the backup failed: ' + xhr.responseText;
+        }
+    };
+    xhr.send(JSON.stringify({name: name}));
 }
 function disconnectKU() {
     displayButtonState('cfgDisconnectBtn', true)
@@ -369,12 +621,24 @@ function handleShowKUCfg(resp) {
         document.getElementById('preferSDCard').checked = kuConfig.opts.preferSDCard;
         document.getElementById('preferKepub').checked = kuConfig.opts.preferKepub;
         document.getElementById('enableDebug').checked = kuConfig.opts.enableDebug;
+        document.getElementById('showStoreBooks').checked = kuConfig.opts.showStoreBooks;
+        document.getElementById('listPendingBooks').checked = kuConfig.opts.listPendingBooks;
+        document.getElementById('pruneMissingBooks').checked = kuConfig.opts.pruneMissingBooks;
+        document.getElementById('dryRun').checked = kuConfig.opts.dryRun;
         //document.getElementById('excludeFormats').value = kuConfig.opts.excludeFormats.toString();
         var formatLabels = document.querySelectorAll('#excludeFormatsContainer label');
         for(var i = 0; i < formatLabels.length; i++) {
             var lbl = formatLabels[i];
             document.getElementById(lbl.htmlFor).checked = (kuConfig.opts.excludeFormats.indexOf(lbl.innerText) === -1);
         }
+        var mdFields = document.querySelectorAll('#metadataFieldsContainer input');
+        for(var i = 0; i < mdFields.length; i++) {
+            mdFields[i].checked = kuConfig.opts.metadataFields[mdFields[i].dataset.mdField];
+        }
+        document.getElementById('seriesMatching').checked = kuConfig.opts.seriesMatching.enabled;
+        document.getElementById('seriesIgnorePunctuation').checked = kuConfig.opts.seriesMatching.ignorePunctuation;
+        document.getElementById('seriesIgnorePrefixes').value = kuConfig.opts.seriesMatching.ignorePrefixes.join(', ');
+        document.getElementById('seriesIgnoreSuffixes').value = kuConfig.opts.seriesMatching.ignoreSuffixes.join(', ');
         document.getElementById('generateLevel').value = kuConfig.opts.thumbnail.generateLevel;
         document.getElementById('resizeAlgorithm').value = kuConfig.opts.thumbnail.resizeAlgorithm;
         document.getElementById('jpegQuality').value = kuConfig.opts.thumbnail.jpegQuality;
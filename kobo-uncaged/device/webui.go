@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"log"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
 	"github.com/shermp/UNCaGED/uc"
 	"github.com/unrolled/render"
 )
@@ -44,6 +47,22 @@ func (k *Kobo) initRouter() {
 	k.webInfo.LibInfoPath = "/libinfo"
 	k.mux.HandlerFunc("GET", k.webInfo.LibInfoPath, k.HandleLibraryInfo)
 	k.mux.HandlerFunc("POST", k.webInfo.LibInfoPath, k.HandleLibraryInfo)
+	k.webInfo.ResultsPath = "/results"
+	k.mux.HandlerFunc("GET", k.webInfo.ResultsPath, k.HandleResults)
+	k.webInfo.ReconcilePath = "/reconcile"
+	k.mux.HandlerFunc("GET", k.webInfo.ReconcilePath, k.HandleReconciled)
+	k.webInfo.BackupsPath = "/backups"
+	k.mux.HandlerFunc("GET", k.webInfo.BackupsPath, k.HandleBackups)
+	k.mux.HandlerFunc("POST", k.webInfo.BackupsPath, k.HandleBackups)
+	k.webInfo.DryRunPath = "/dryrun"
+	k.mux.HandlerFunc("GET", k.webInfo.DryRunPath, k.HandleDryRun)
+	k.webInfo.OrphansPath = "/orphans"
+	k.mux.HandlerFunc("GET", k.webInfo.OrphansPath, k.HandleOrphans)
+	k.webInfo.AnnotationsPath = "/annotations"
+	k.mux.HandlerFunc("GET", k.webInfo.AnnotationsPath, k.HandleAnnotations)
+	k.mux.ServeFiles(k.webInfo.AnnotationsPath+"/files/*filepath", http.Dir(filepath.Join(k.DBRootDir, kuAnnotationsDir)))
+	k.webInfo.SeriesPath = "/series"
+	k.mux.HandlerFunc("POST", k.webInfo.SeriesPath, k.HandleSeriesPreview)
 	k.webInfo.DisconnectPath = "/ucexit"
 	k.mux.HandlerFunc("GET", k.webInfo.DisconnectPath, k.HandleUCExit)
 	fsys, _ := fs.Sub(web_files, "web/static")
@@ -64,6 +83,7 @@ func (k *Kobo) initRender() {
 // HandleIndex displays a form allowing the user to customize
 // KU. It uses the existing ku.toml file as a seed
 func (k *Kobo) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	k.webInfo.Warnings = recoveredWarnings(util.RecoveredFiles())
 	k.rend.HTML(w, http.StatusOK, "kuPage", k.webInfo)
 }
 
@@ -80,6 +100,8 @@ func (k *Kobo) HandleConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		res.Opts = *k.KuConfig
 		k.rend.JSON(w, http.StatusOK, res)
+	} else if err := k.startSession(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
 	} else {
 		defer close(k.startChan)
 		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
@@ -90,6 +112,20 @@ func (k *Kobo) HandleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// startSession records that the session has started, unless it already has,
+// or a restored snapshot requires the Kobo to restart first
+func (k *Kobo) startSession() error {
+	k.sessionMu.Lock()
+	defer k.sessionMu.Unlock()
+	if k.snapshotRestored {
+		return fmt.Errorf("the Kobo must restart before starting, as a backup was restored")
+	} else if k.sessionStarted {
+		return fmt.Errorf("the session has already started")
+	}
+	k.sessionStarted = true
+	return nil
+}
+
 // HandleMessages sends messages to the client using server sent events.
 func (k *Kobo) HandleMessages(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -102,7 +138,7 @@ func (k *Kobo) HandleMessages(w http.ResponseWriter, r *http.Request) {
 	for {
 		select {
 		case msg := <-k.MsgChan:
-			if !msg.GetPassword && !msg.GetCalInstance && !msg.GetLibInfo && msg.Finished == "" {
+			if !msg.GetPassword && !msg.GetCalInstance && !msg.GetLibInfo && msg.Finished == "" && msg.Warning == "" {
 				// Note, we replace all newlines in the message with spaces. That is because server
 				// sent events are newline delimited
 				if msg.ShowMessage != "" {
@@ -125,6 +161,9 @@ func (k *Kobo) HandleMessages(w http.ResponseWriter, r *http.Request) {
 			} else if msg.Finished != "" {
 				fmt.Fprintf(w, "event: kuFinished\ndata: %s\n\n", strings.ReplaceAll(msg.Finished, "\n", " "))
 				f.Flush()
+			} else if msg.Warning != "" {
+				fmt.Fprintf(w, "event: warning\ndata: %s\n\n", strings.ReplaceAll(msg.Warning, "\n", " "))
+				f.Flush()
 			}
 			k.doneChan <- true
 		case <-r.Context().Done():
@@ -167,11 +206,8 @@ func (k *Kobo) HandleLibraryInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		stdFields := make([]string, 0)
 		userFields := make([]string, 0)
-		allFields := []string{""}
-		selField := ""
-		if libOpt, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists {
-			selField = libOpt.SubtitleColumn
-		}
+		// Custom columns of each datatype, for the reading state columns
+		typeFields := make(map[uc.CalibreColumnDataType][]string)
 		for name, field := range k.LibInfo.FieldMetadata {
 			switch name {
 			case "languages", "tags", "rating", "publisher":
@@ -179,33 +215,147 @@ func (k *Kobo) HandleLibraryInfo(w http.ResponseWriter, r *http.Request) {
 			default:
 				if field.IsCustom {
 					userFields = append(userFields, name)
+					typeFields[field.Datatype] = append(typeFields[field.Datatype], name)
 				}
 			}
 		}
 		sort.Strings(stdFields)
 		sort.Strings(userFields)
-		allFields = append(allFields, stdFields...)
-		allFields = append(allFields, userFields...)
-		wlo := webLibOpts{CurrSel: 0, SubtitleFields: allFields}
-		for i, field := range allFields {
-			if field == selField {
-				wlo.CurrSel = i
+		// Every list starts with an empty entry, to allow the user to disable the option
+		fieldList := func(fieldLists ...[]string) []string {
+			fields := []string{""}
+			for _, f := range fieldLists {
+				fields = append(fields, f...)
 			}
+			sort.Strings(fields[1:])
+			return fields
 		}
+		wlo := webLibOpts{Fields: make(map[string][]string)}
+		if libOpt, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists {
+			wlo.Opts = libOpt
+		}
+		wlo.Fields["subtitle"] = append(append([]string{""}, stdFields...), userFields...)
+		wlo.Fields["readStatus"] = fieldList(typeFields["bool"], typeFields["int"])
+		wlo.Fields["number"] = fieldList(typeFields["int"], typeFields["float"])
+		wlo.Fields["datetime"] = fieldList(typeFields["datetime"])
+		wlo.Fields["bool"] = fieldList(typeFields["bool"])
+		wlo.Fields["comments"] = fieldList(typeFields["comments"])
+		wlo.Fields["collections"] = fieldList([]string{"tags", "series"}, typeFields["text"], typeFields["series"], typeFields["enumeration"])
 		k.rend.JSON(w, http.StatusOK, wlo)
 	} else {
 		var wlo webLibOpts
 		if err := json.NewDecoder(r.Body).Decode(&wlo); err != nil {
-			http.Error(w, "error getting subtitle field from client", http.StatusInternalServerError)
+			http.Error(w, "error getting library options from client", http.StatusInternalServerError)
+			return
 		}
 		if k.KuConfig.LibOptions == nil {
 			k.KuConfig.LibOptions = make(map[string]KuLibOptions)
 		}
-		k.KuConfig.LibOptions[k.LibInfo.LibraryUUID] = KuLibOptions{SubtitleColumn: wlo.SubtitleFields[wlo.CurrSel]}
+		k.KuConfig.LibOptions[k.LibInfo.LibraryUUID] = wlo.Opts
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
+// HandleResults sends the outcome of the Nickel database update to the client
+func (k *Kobo) HandleResults(w http.ResponseWriter, r *http.Request) {
+	results := k.updateResults
+	if results == nil {
+		results = make([]bookUpdateResult, 0)
+	}
+	k.rend.JSON(w, http.StatusOK, results)
+}
+
+// HandleReconciled sends the client the books where the files, Nickel DB
+// and metadata cache disagreed
+func (k *Kobo) HandleReconciled(w http.ResponseWriter, r *http.Request) {
+	entries := k.reconciled
+	if entries == nil {
+		entries = make([]reconcileEntry, 0)
+	}
+	k.rend.JSON(w, http.StatusOK, entries)
+}
+
+// HandleDryRun sends the client the changes a dry run session skipped
+func (k *Kobo) HandleDryRun(w http.ResponseWriter, r *http.Request) {
+	k.rend.JSON(w, http.StatusOK, k.dryRunChanges())
+}
+
+// HandleOrphans sends the client the annotations that could not be
+// reattached to replaced books
+func (k *Kobo) HandleOrphans(w http.ResponseWriter, r *http.Request) {
+	orphaned := k.orphaned
+	if orphaned == nil {
+		orphaned = make([]orphanedAnnotation, 0)
+	}
+	k.rend.JSON(w, http.StatusOK, orphaned)
+}
+
+// HandleAnnotations sends the list of annotation backup files to the client
+func (k *Kobo) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
+	files, err := k.listAnnotationBackups()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.rend.JSON(w, http.StatusOK, files)
+}
+
+// HandleBackups sends the list of snapshots to the client, or restores the
+// snapshot the client chose
+func (k *Kobo) HandleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := k.listSnapshots()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		k.rend.JSON(w, http.StatusOK, snapshots)
+	case http.MethodPost:
+		// The session can't start while a snapshot is being restored
+		k.sessionMu.Lock()
+		defer k.sessionMu.Unlock()
+		if k.sessionStarted {
+			http.Error(w, "snapshots can only be restored before starting", http.StatusConflict)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error getting snapshot name from client", http.StatusBadRequest)
+			return
+		}
+		if err := k.restoreSnapshot(req.Name); err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The client has to exit, so the Kobo can be restarted before the
+		// restored DB is used
+		k.snapshotRestored = true
+		k.rend.JSON(w, http.StatusOK, struct {
+			Restart bool `json:"restart"`
+		}{k.useNDB})
+	}
+}
+
+// HandleSeriesPreview sends the client the SeriesID each sideloaded series
+// would get, using the series matching options the client sent
+func (k *Kobo) HandleSeriesPreview(w http.ResponseWriter, r *http.Request) {
+	var opts seriesMatchOption
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, "error getting series matching options from client", http.StatusInternalServerError)
+		return
+	}
+	matches, err := k.previewSeriesMatches(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.rend.JSON(w, http.StatusOK, matches)
+}
+
 // HandleUCExit lets the user stop UNCaGED client side, without having to disconnect via Calibre
 func (k *Kobo) HandleUCExit(w http.ResponseWriter, r *http.Request) {
 	if k.UCExitChan != nil {
@@ -216,6 +366,35 @@ func (k *Kobo) HandleUCExit(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// recoveredWarnings creates a warning for each file that was read from its backup
+func recoveredWarnings(files []util.RecoveredFile) []string {
+	warnings := make([]string, 0, len(files))
+	for _, f := range files {
+		problem := "damaged"
+		if f.Missing {
+			problem = "missing"
+		}
+		warnings = append(warnings, fmt.Sprintf("%s was %s, and has been restored from a backup. Recent changes to it may be lost.", filepath.Base(f.Name), problem))
+	}
+	return warnings
+}
+
+// warnRecovered warns the user about files read from their backup since
+// the last warning
+func (k *Kobo) warnRecovered() {
+	files := util.RecoveredFiles()
+	if len(files) <= k.warnedFiles {
+		return
+	}
+	for _, warning := range recoveredWarnings(files[k.warnedFiles:]) {
+		log.Println(warning)
+		if k.BrowserOpen {
+			k.WebSend(WebMsg{Warning: warning, Progress: IgnoreProgress})
+		}
+	}
+	k.warnedFiles = len(files)
+}
+
 // WebSend is a small function to print a message to webclient, and wait for to be sent before returning
 func (k *Kobo) WebSend(msg WebMsg) {
 	k.MsgChan <- msg
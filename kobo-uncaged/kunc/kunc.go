@@ -26,7 +26,6 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/device"
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
@@ -67,24 +66,31 @@ func (ku *koboUncaged) GetClientOptions() (uc.ClientOptions, error) {
 // A nil slice is interpreted has having no books on the device
 func (ku *koboUncaged) GetDeviceBookList() ([]uc.BookCountDetails, error) {
 	bc := []uc.BookCountDetails{}
-	for k, md := range ku.k.MetadataMap {
+	ku.k.Metadata.Iterate(func(cid string, md device.BookMeta) bool {
 		if md.Meta == nil {
 			// For some reason we don't have metadata on this book. This SHOULD not
 			// happen, but lets account for the possiblity
-			continue
-		}
-		fmt.Println(k)
-		lastMod := time.Now()
-		if md.Meta.LastModified.GetTime() != nil {
-			lastMod = *md.Meta.LastModified.GetTime()
+			return true
 		}
+		// Calibre's book list has no field for the digest of a book file, so it is
+		// only used to detect replaced books in SaveBook
 		bcd := uc.BookCountDetails{
 			UUID:         md.Meta.UUID,
 			Lpath:        md.Meta.Lpath,
-			LastModified: lastMod,
+			LastModified: ku.k.BookLastModified(md.Meta),
 		}
 		bcd.Extension = filepath.Ext(md.Meta.Lpath)
 		bc = append(bc, bcd)
+		return true
+	})
+	// Store books are read-only, but Calibre can still see and match them
+	for _, md := range ku.k.StoreBooks {
+		bc = append(bc, uc.BookCountDetails{
+			UUID:         md.Meta.UUID,
+			Lpath:        md.Meta.Lpath,
+			LastModified: ku.k.BookLastModified(md.Meta),
+			Extension:    ".kepub",
+		})
 	}
 	return bc, nil
 }
@@ -93,12 +99,20 @@ func (ku *koboUncaged) GetMetadataIter(books []uc.BookID) uc.MetadataIter {
 	iter := device.NewMetaIter(ku.k)
 	if len(books) > 0 {
 		for _, bk := range books {
+			if ku.k.IsStoreBook(bk.Lpath) {
+				iter.Add(bk.Lpath)
+				continue
+			}
 			cid := util.LpathToContentID(bk.Lpath, string(ku.k.ContentIDprefix))
 			iter.Add(cid)
 		}
 	} else {
-		for cid := range ku.k.MetadataMap {
+		ku.k.Metadata.Iterate(func(cid string, _ device.BookMeta) bool {
 			iter.Add(cid)
+			return true
+		})
+		for lpath := range ku.k.StoreBooks {
+			iter.Add(lpath)
 		}
 	}
 	return iter
@@ -126,15 +140,25 @@ func (ku *koboUncaged) SetLibraryInfo(libInfo uc.CalibreLibraryInfo) error {
 // UpdateMetadata instructs the client to update their metadata according to the
 // new slice of metadata maps
 func (ku *koboUncaged) UpdateMetadata(mdList []uc.CalibreBookMeta) error {
+	cids := make([]string, 0, len(mdList))
 	for _, md := range mdList {
+		if ku.k.IsStoreBook(md.Lpath) {
+			// Store book metadata is managed by Nickel
+			continue
+		}
+		// The store keeps a pointer, so don't hand it the loop variable
+		md := md
 		md.Thumbnail = nil
 		cid := util.LpathToContentID(md.Lpath, string(ku.k.ContentIDprefix))
-		meta := ku.k.MetadataMap[cid]
-		meta.UpdatedBook = true
-		meta.Meta = &md
-		ku.k.MetadataMap[cid] = meta
+		ku.k.Metadata.Put(cid, &md)
+		cids = append(cids, cid)
+	}
+	if ku.k.DryRun() {
+		ku.k.DryRunf("would record updated metadata for %d book(s)", len(cids))
+	}
+	if err := ku.k.RecordMetadata(cids...); err != nil {
+		return fmt.Errorf("UpdateMetadata: error recording metadata: %w", err)
 	}
-	ku.k.WriteMDfile()
 	return nil
 }
 
@@ -160,6 +184,9 @@ func (ku *koboUncaged) GetFreeSpace() uint64 {
 
 // CheckLpath asks the client to verify a provided Lpath, and change it if required
 // Return the original string if the Lpath does not need changing
+// Note, UNCaGED only provides the lpath here, not the metadata of the book being sent,
+// so books cannot be placed with a template of their metadata (eg: {author_sort}/{title})
+// until UNCaGED passes the uc.CalibreBookMeta of the book to CheckLpath.
 func (ku *koboUncaged) CheckLpath(lpath string) (newLpath string) {
 	// The calibre wireless driver does not sanitize the filepath for us. We sanitize it here,
 	// and if lpath changes, inform Calibre of the new lpath.
@@ -167,7 +194,8 @@ func (ku *koboUncaged) CheckLpath(lpath string) (newLpath string) {
 	// Also, for kepub files, Calibre defaults to using "book/path.kepub"
 	// but we require "book/path.kepub.epub". We change that here if needed.
 	newLpath = util.LpathKepubConvert(newLpath)
-	return newLpath
+	// New books are kept clear of filesystem limits and other books
+	return ku.k.ResolveLpath(newLpath)
 }
 
 // SaveBook saves a book with the provided metadata to the disk.
@@ -176,53 +204,60 @@ func (ku *koboUncaged) CheckLpath(lpath string) (newLpath string) {
 // newLpath informs UNCaGED of an Lpath change. Use this if the lpath field in md is
 // not valid (eg filesystem limitations.). Return an empty string if original lpath is valid
 func (ku *koboUncaged) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int, lastBook bool) (err error) {
+	if ku.k.IsStoreBook(md.Lpath) {
+		// Read the book anyway, so the connection to Calibre is left in a sane state.
+		// Returning an error would end the session, losing the rest of its changes.
+		if _, err = io.CopyN(io.Discard, book, int64(len)); err != nil {
+			return fmt.Errorf("SaveBook: error reading ebook: %w", err)
+		}
+		ku.k.Warn(fmt.Sprintf("Refused to overwrite store book '%s'", md.Title))
+		return nil
+	}
 	cID := util.LpathToContentID(md.Lpath, string(ku.k.ContentIDprefix))
 	bkPath := util.ContentIDtoBkPath(ku.k.BKRootDir, cID, string(ku.k.ContentIDprefix))
-	bkDir, _ := filepath.Split(bkPath)
-	err = os.MkdirAll(bkDir, 0777)
-	if err != nil {
-		return fmt.Errorf("SaveBook: error making book directories: %w", err)
-	}
-	destBook, err := os.Create(bkPath)
-	if err != nil {
-		return fmt.Errorf("SaveBook: error opening ebook file: %w", err)
+	if err = ku.k.BackupBeforeWrite(); err != nil {
+		io.CopyN(io.Discard, book, int64(len))
+		return fmt.Errorf("SaveBook: %w", err)
 	}
-	defer destBook.Close()
 	ku.k.WebSend(device.WebMsg{ShowMessage: fmt.Sprintf("Transferring<br/><i>%s - %s</i>", strings.Join(md.Authors, " "), md.Title),
 		Progress: device.IgnoreProgress})
 	// We don't need to save the calibre cover path in metadata.calibre
 	if md.Cover != nil {
 		md.Cover = nil
 	}
-	var done chan struct{}
-	// Note, the JSON format for covers should be in the form 'thumbnail: [w, h, "base64string"]'
-	if md.Thumbnail.Exists() && ku.k.KuConfig.Thumbnail.GenerateLevel != device.GenerateNone {
-		w, h := md.Thumbnail.Dimensions()
-		done = make(chan struct{})
-		go ku.k.SaveCoverImage(cID, image.Pt(w, h), md.Thumbnail.ImgBase64(), done)
-	}
+	thumbnail := md.Thumbnail
 	// Set the Thumbnail field to nil to avoid saving it to the metadata.calibre file
-	// Hopefully the garbage collector will delete the string once the
-	// above goroutine is finished with it
 	md.Thumbnail = nil
-	if _, err = io.CopyN(destBook, book, int64(len)); err != nil {
-		return fmt.Errorf("SaveBook: error writing ebook to file: %w", err)
+	// The chapters of the previous copy are compared with the new one, so
+	// bookmarks can follow chapters that moved
+	oldSpine := ku.k.BookSpine(cID)
+	// The previous copy of the book is only replaced once the new one has
+	// been received in full
+	digest, err := ku.k.ReceiveBook(bkPath, book, len)
+	if err != nil {
+		return fmt.Errorf("SaveBook: %w", err)
 	}
-	ku.k.UpdateIfExists(cID, len)
-	meta := ku.k.MetadataMap[cID]
-	if _, exists := ku.k.MetadataMap[cID]; exists {
-		meta.UpdatedBook = true
-	} else {
-		meta.NewBook = true
+	var done chan struct{}
+	// Note, the JSON format for covers should be in the form 'thumbnail: [w, h, "base64string"]'
+	if thumbnail.Exists() && ku.k.KuConfig.Thumbnail.GenerateLevel != device.GenerateNone && !ku.k.DryRun() {
+		w, h := thumbnail.Dimensions()
+		// Buffered, so the goroutine can finish even if we return early below
+		done = make(chan struct{}, 1)
+		go ku.k.SaveCoverImage(cID, image.Pt(w, h), thumbnail.ImgBase64(), done)
+	}
+	ku.k.TrackReceivedBook(cID, &md, len)
+	ku.k.UpdateIfExists(cID, len, digest)
+	ku.k.QueueChapterRemap(cID, oldSpine)
+	ku.k.Metadata.Put(cID, &md)
+	ku.k.Metadata.SetSHA256(cID, digest)
+	if err = ku.k.RecordMetadata(cID); err != nil {
+		return fmt.Errorf("SaveBook: error recording metadata: %w", err)
 	}
-	meta.Meta = &md
-	ku.k.MetadataMap[cID] = meta
 	// Wait for the thumbnail generation to finish
 	if done != nil {
 		<-done
 	}
 	if lastBook {
-		ku.k.WriteMDfile()
 		ku.k.WebSend(device.WebMsg{ShowMessage: "Transfer Complete", Progress: -1})
 	}
 	return err
@@ -250,6 +285,11 @@ func (ku *koboUncaged) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, in
 // Error is returned if the book was unable to be deleted
 func (ku *koboUncaged) DeleteBook(book uc.BookID) error {
 	var err error
+	if ku.k.IsStoreBook(book.Lpath) {
+		// Returning an error would end the session, losing the rest of its changes
+		ku.k.Warn(fmt.Sprintf("Refused to delete store book %s", book.Lpath))
+		return nil
+	}
 	// Start with basic book deletion. A more fancy implementation can come later
 	// (eg: removing cover image remnants etc)
 	cid := util.LpathToContentID(book.Lpath, string(ku.k.ContentIDprefix))
@@ -260,6 +300,15 @@ func (ku *koboUncaged) DeleteBook(book uc.BookID) error {
 		ku.k.DebugLogPrintf("CID: %s, bkPath: %s, dir: %s, dirPath: %s\n", cid, bkPath, dir, dirPath)
 	}
 	ku.k.WebSend(device.WebMsg{ShowMessage: fmt.Sprintf("Deleting: %s", bkPath), Progress: device.IgnoreProgress})
+	if ku.k.DryRun() {
+		ku.k.DryRunf("would delete %s", bkPath)
+		ku.k.TrackDeletedBook(cid)
+		ku.k.Metadata.Delete(cid)
+		return nil
+	}
+	if err = ku.k.BackupBeforeWrite(); err != nil {
+		return fmt.Errorf("DeleteBook: %w", err)
+	}
 	if err = os.Remove(bkPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("DeleteBook: error deleting file: %w", err)
 	}
@@ -273,11 +322,13 @@ func (ku *koboUncaged) DeleteBook(book uc.BookID) error {
 		// Walk 'up' the path
 		dirPath = filepath.Clean(filepath.Join(dirPath, "../"))
 	}
-	// Now we remove the book from the metadata map
-	delete(ku.k.MetadataMap, cid)
-	// Finally, write the new metadata files
-	if err = ku.k.WriteMDfile(); err != nil {
-		return fmt.Errorf("DeleteBook: error writing metadata file: %w", err)
+	// Now we remove the book from the metadata map. Calibre may be moving the
+	// book, in which case its history follows it to the new lpath.
+	ku.k.TrackDeletedBook(cid)
+	ku.k.Metadata.Delete(cid)
+	// Finally, record the deletion
+	if err = ku.k.RecordDeletion(book.Lpath); err != nil {
+		return fmt.Errorf("DeleteBook: error recording deletion: %w", err)
 	}
 	return nil
 }
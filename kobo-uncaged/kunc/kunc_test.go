@@ -0,0 +1,25 @@
+package kunc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/device"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestRefuseStoreBook(t *testing.T) {
+	ku := New(&device.Kobo{KuConfig: &device.KuOptions{}})
+	lpath := ".kobo/kepub/0a1b2c3d"
+	// UNCaGED ends the session on any error, so refusing a store book must not return one
+	book := strings.NewReader("store book")
+	if err := ku.SaveBook(uc.CalibreBookMeta{Lpath: lpath, Title: "Store Book"}, book, book.Len(), true); err != nil {
+		t.Errorf("SaveBook() = %v, want nil", err)
+	}
+	if book.Len() != 0 {
+		t.Errorf("%d bytes of the book left unread", book.Len())
+	}
+	if err := ku.DeleteBook(uc.BookID{Lpath: lpath}); err != nil {
+		t.Errorf("DeleteBook() = %v, want nil", err)
+	}
+}
@@ -20,6 +20,7 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"log/syslog"
@@ -89,11 +90,12 @@ func mainWithErrCode() returnCode {
 	sdMntPtr := flag.String("sdmount", "", "If changed, specify the new new mountpoint of '/mnt/sd'")
 	bindAddrPtr := flag.String("bindaddr", "127.0.0.1:8181", "Specify the network address and port <IP:POrt> to listen on")
 	disableNDBPtr := flag.Bool("disablendb", false, "Disables use of NickelDBus. Useful for desktop testing")
+	dryRunPtr := flag.Bool("dryrun", false, "Report the changes that would be made to the device, without making them")
 
 	flag.Parse()
 	log.Println("Started Kobo-UNCaGED")
 	log.Println("Creating KU object")
-	k, err := device.New(*onboardMntPtr, *sdMntPtr, *bindAddrPtr, *disableNDBPtr, kuVersion)
+	k, err := device.New(*onboardMntPtr, *sdMntPtr, *bindAddrPtr, *disableNDBPtr, *dryRunPtr, kuVersion)
 	if err != nil {
 		log.Print(err)
 		return returncodeFromError(err, nil)
@@ -115,6 +117,10 @@ func mainWithErrCode() returnCode {
 		log.Print(err)
 		return returncodeFromError(err, k)
 	}
+	if err = k.CompactMDfile(); err != nil {
+		// The journal is still there, so the changes will be recovered next time
+		log.Print(err)
+	}
 	if err = k.WritePassCache(); err != nil {
 		// Not fatal, just log it
 		log.Print(err)
@@ -123,24 +129,32 @@ func mainWithErrCode() returnCode {
 		// Annoying, but not fatal
 		log.Print(err)
 	}
-	updateReq, err := k.WriteUpdatedMetadataSQL()
+	updated, failed, err := k.UpdateNickelDB()
 	if err != nil {
 		k.FinishedMsg = "Updating metadata failed"
 		log.Print(err)
 		return returncodeFromError(err, k)
 	}
+	if _, err = k.BackupAnnotations(); err != nil {
+		// The annotations are still in the Nickel DB, so not fatal
+		log.Print(err)
+	}
+	lineBreak := "\n"
 	if k.BrowserOpen {
-		if updateReq {
-			k.FinishedMsg = "Calibre disconnected<br>Metadata will be updated<br><br>Please wait"
-		} else {
-			k.FinishedMsg = "Calibre disconnected<br><br>Please wait"
-		}
-	} else {
-		if updateReq {
-			k.FinishedMsg = "Calibre disconnected\nMetadata will be updated\n\nPlease wait"
-		} else {
-			k.FinishedMsg = "Calibre disconnected\n\nPlease wait"
-		}
+		lineBreak = "<br>"
+	}
+	k.FinishedMsg = "Calibre disconnected"
+	if updated > 0 {
+		k.FinishedMsg += fmt.Sprintf("%sMetadata updated for %d book(s)", lineBreak, updated)
+	}
+	if failed > 0 {
+		k.FinishedMsg += fmt.Sprintf("%sMetadata update failed for %d book(s)", lineBreak, failed)
+	}
+	if n := k.OrphanedAnnotations(); n > 0 {
+		k.FinishedMsg += fmt.Sprintf("%s%d annotation(s) could not be reattached to replaced books", lineBreak, n)
+	}
+	if k.DryRun() {
+		k.FinishedMsg += fmt.Sprintf("%sDry run: nothing was changed", lineBreak)
 	}
 	return succsess
 }
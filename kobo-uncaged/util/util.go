@@ -3,10 +3,14 @@ package util
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var invalidCharsRegex = regexp.MustCompile(`[\\?%\*:;\|\"\'><\$!]`)
@@ -56,46 +60,153 @@ func StringSliceContains(strSlice []string, val string) bool {
 	return false
 }
 
-// SafeSQLString constructs a safe string to feed to SQLite3 CLI
-// Queries made in Go should use prepared statements/parameters
-// instead. This is also not safe for LIKE queries
-func SafeSQLString(s *string) string {
-	if s != nil {
-		return fmt.Sprintf("'%s'", strings.ReplaceAll(*s, "'", "''"))
+// iso6393to1 maps the three letter language codes Calibre uses to the
+// two letter codes Nickel uses. Only reasonably common languages are included.
+var iso6393to1 = map[string]string{
+	"afr": "af", "ara": "ar", "bul": "bg", "cat": "ca", "ces": "cs", "cze": "cs",
+	"chi": "zh", "zho": "zh", "dan": "da", "deu": "de", "ger": "de", "ell": "el",
+	"gre": "el", "eng": "en", "epo": "eo", "est": "et", "eus": "eu", "baq": "eu",
+	"fas": "fa", "per": "fa", "fin": "fi", "fra": "fr", "fre": "fr", "gle": "ga",
+	"glg": "gl", "heb": "he", "hin": "hi", "hrv": "hr", "hun": "hu", "ind": "id",
+	"isl": "is", "ice": "is", "ita": "it", "jpn": "ja", "kor": "ko", "lat": "la",
+	"lit": "lt", "lav": "lv", "msa": "ms", "may": "ms", "nld": "nl", "dut": "nl",
+	"nob": "nb", "nno": "nn", "nor": "no", "pol": "pl", "por": "pt", "ron": "ro",
+	"rum": "ro", "rus": "ru", "slk": "sk", "slo": "sk", "slv": "sl", "spa": "es",
+	"srp": "sr", "swe": "sv", "tha": "th", "tur": "tr", "ukr": "uk", "vie": "vi",
+	"wel": "cy", "cym": "cy",
+}
+
+// LangToISO6391 converts a language code from Calibre to the two letter
+// ISO 639-1 code Nickel expects. The empty string is returned if
+// the language is unknown.
+func LangToISO6391(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if len(lang) == 2 {
+		return lang
 	}
-	return "NULL"
+	return iso6393to1[lang]
 }
 
-// WriteJSON is a helper function to write JSON to a file
-func WriteJSON(fn string, v interface{}) error {
-	var err error
-	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// WriteFileAtomic writes to fn by calling write with a temporary file, which
+// is synced and renamed over fn once write succeeds. If keepBackup is true,
+// the previous version of fn is kept as fn.bak
+func WriteFileAtomic(fn string, keepBackup bool, write func(w io.Writer) error) error {
+	tmpFn := fn + ".tmp"
+	f, err := os.OpenFile(tmpFn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("WriteFileAtomic OpenFile: %w", err)
+	}
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("WriteJSON OpenFile: %w", err)
+		os.Remove(tmpFn)
+		return fmt.Errorf("WriteFileAtomic write: %w", err)
+	}
+	if keepBackup {
+		if err = os.Rename(fn, fn+".bak"); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmpFn)
+			return fmt.Errorf("WriteFileAtomic backup: %w", err)
+		}
+	}
+	if err = os.Rename(tmpFn, fn); err != nil {
+		return fmt.Errorf("WriteFileAtomic Rename: %w", err)
 	}
-	defer f.Close()
+	// Make sure the renames make it to disk. Not all filesystems support
+	// syncing directories, so errors are ignored.
+	if d, err := os.Open(filepath.Dir(fn)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// WriteJSON is a helper function to write JSON to a file. The file is
+// written atomically, and the previous version kept as a backup.
+func WriteJSON(fn string, v interface{}) error {
+	return WriteFileAtomic(fn, true, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("WriteJSON Encode: %w", err)
+		}
+		return nil
+	})
+}
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "    ")
-	if err = enc.Encode(v); err != nil {
-		err = fmt.Errorf("WriteJSON Encode: %w", err)
+// RecoveredFile is a file that was read from its backup
+type RecoveredFile struct {
+	Name string
+	// Missing is set if the file was missing or empty, rather than damaged
+	Missing bool
+}
+
+var (
+	recoveredMu sync.Mutex
+	recovered   []RecoveredFile
+)
+
+// RecoveredFiles lists the files that could not be read, and were read from
+// their backup instead
+func RecoveredFiles() []RecoveredFile {
+	recoveredMu.Lock()
+	defer recoveredMu.Unlock()
+	return append([]RecoveredFile(nil), recovered...)
+}
+
+// ReadJSONStream opens fn, and calls decode with a JSON decoder for it. If
+// fn is missing, or decode fails, the backup written by WriteJSON is tried
+// instead. decode must reset anything it has set before it returns an error,
+// as it may be called a second time.
+func ReadJSONStream(fn string, decode func(dec *json.Decoder) error) (emptyOrNotExist bool, err error) {
+	decodeFile := func(fn string) (bool, error) {
+		f, err := GetFileRead(fn)
+		if err != nil {
+			return false, fmt.Errorf("ReadJSON Open: %w", err)
+		} else if f == nil {
+			return true, nil
+		}
+		defer f.Close()
+		if err = decode(json.NewDecoder(f)); err != nil {
+			return false, fmt.Errorf("ReadJSON Decode: %w", err)
+		}
+		return false, nil
 	}
-	return err
+	emptyOrNotExist, err = decodeFile(fn)
+	if err == nil && !emptyOrNotExist {
+		return false, nil
+	}
+	bakEmptyOrNotExist, bakErr := decodeFile(fn + ".bak")
+	if bakErr != nil || bakEmptyOrNotExist {
+		// The backup is no better, report on the original
+		return emptyOrNotExist, err
+	}
+	if err == nil {
+		log.Printf("ReadJSON: %s is missing or empty, using backup", fn)
+	} else {
+		log.Printf("ReadJSON: %s could not be read, using backup. Error was: %v", fn, err)
+	}
+	recoveredMu.Lock()
+	recovered = append(recovered, RecoveredFile{Name: fn, Missing: err == nil})
+	recoveredMu.Unlock()
+	return false, nil
 }
 
 // ReadJSON is a helper function to read JSON from a file
 func ReadJSON(fn string, out interface{}) (emptyOrNotExist bool, err error) {
-	f, err := GetFileRead(fn)
-	if err != nil {
-		return false, fmt.Errorf("ReadJSON Open: %w", err)
-	} else if f == nil {
-		return true, nil
-	}
-	defer f.Close()
-	if err = json.NewDecoder(f).Decode(out); err != nil {
-		err = fmt.Errorf("ReadJSON Decode: %w", err)
-	}
-	return false, err
+	return ReadJSONStream(fn, func(dec *json.Decoder) error {
+		err := dec.Decode(out)
+		if err != nil {
+			// Don't leave a partial decode behind for the backup to be decoded over
+			if v := reflect.ValueOf(out); v.Kind() == reflect.Ptr && !v.IsNil() {
+				v.Elem().Set(reflect.Zero(v.Elem().Type()))
+			}
+		}
+		return err
+	})
 }
 
 // GetFileRead opens fn in read only mode. If the returned file
@@ -1 +1,56 @@
 package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLangToISO6391(t *testing.T) {
+	tests := map[string]string{
+		"eng": "en",
+		"fre": "fr",
+		"fra": "fr",
+		"DEU": "de",
+		"en":  "en",
+		"xyz": "",
+		"":    "",
+	}
+	for in, want := range tests {
+		if got := LangToISO6391(in); got != want {
+			t.Errorf("LangToISO6391(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReadJSONBackup(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.json")
+	for _, v := range []int{1, 2} {
+		if err := WriteJSON(fn, map[string]int{"v": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Simulate a damaged primary file, which is partially decoded before failing
+	if err := os.WriteFile(fn, []byte(`{"w": 4, "v": "3"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int
+	if _, err := ReadJSON(fn, &got); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, map[string]int{"v": 1}) {
+		t.Errorf("ReadJSON() from backup = %v, want map[v:1]", got)
+	}
+	// A missing primary file is recovered too, but isn't damaged
+	if err := os.Remove(fn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadJSON(fn, &got); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	want := []RecoveredFile{{Name: fn}, {Name: fn, Missing: true}}
+	if files := RecoveredFiles(); !reflect.DeepEqual(files, want) {
+		t.Errorf("RecoveredFiles() = %v, want %v", files, want)
+	}
+}